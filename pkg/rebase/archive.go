@@ -0,0 +1,291 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// MismatchPolicy says what RebaseArchive does with an image that cannot be
+// rebased because it is not based on the old base, is for another platform
+// than the new base, has no usable rebase LABEL when the bases are read from
+// labels, or has no tags.
+type MismatchPolicy int
+
+const (
+	// MismatchFail fails the whole rebase.
+	MismatchFail MismatchPolicy = iota
+	// MismatchPassThrough copies the image to the new archive unchanged. An
+	// image without tags cannot be written to an archive, and is dropped.
+	MismatchPassThrough
+	// MismatchDrop leaves the image out of the new archive.
+	MismatchDrop
+)
+
+// String returns the name of the policy.
+func (p MismatchPolicy) String() string {
+	switch p {
+	case MismatchFail:
+		return "fail"
+	case MismatchPassThrough:
+		return "pass-through"
+	case MismatchDrop:
+		return "drop"
+	}
+	return fmt.Sprintf("MismatchPolicy(%d)", int(p))
+}
+
+// WithMismatchPolicy sets what RebaseArchive does with images that cannot be
+// rebased. The default is MismatchFail.
+func WithMismatchPolicy(p MismatchPolicy) Option {
+	return func(r *Rebaser) {
+		r.mismatch = p
+	}
+}
+
+// ArchiveResult describes the rebase of every image in an archive.
+type ArchiveResult struct {
+	// Images describes the images of the source archive, in its order.
+	Images []ArchiveImage
+}
+
+// ArchiveImage describes what became of one image of an archive.
+type ArchiveImage struct {
+	// Tags are the tags of the image, which it keeps in the new archive.
+	Tags []string
+	// Result describes the rebased image, or is nil if the image was not
+	// rebased.
+	Result *Result
+	// Mismatch is why the image was not rebased, such as a
+	// *NotBasedOnError, a *PlatformMismatchError, ErrMissingLabel or
+	// ErrUntagged.
+	Mismatch error
+	// Dropped reports whether the image was left out of the new archive.
+	Dropped bool
+}
+
+// RebaseArchive rebases every image in the "docker save" archive at src and
+// writes the results, under the same tags, to a new archive at dst, which is
+// written to stdout if dst is "-". dst may be the same file as src.
+//
+// If oldBaseStr and newBaseStr are empty, each image is rebased onto the
+// bases named by its own rebase LABEL. An image that cannot be rebased is
+// handled according to the Rebaser's MismatchPolicy.
+func (r Rebaser) RebaseArchive(ctx context.Context, src, dst, oldBaseStr, newBaseStr string) (*ArchiveResult, error) {
+	entries, err := readArchiveTags(src, r.strictness)
+	if err != nil {
+		return nil, fmt.Errorf("could not read archive %q: %w", src, err)
+	}
+
+	t := r.roundTripper(ctx)
+	defer t.close()
+	bases := map[string]v1.Image{}
+	base := func(s string) (v1.Image, error) {
+		if img, ok := bases[s]; ok {
+			return img, nil
+		}
+		ctx, cancel := t.phase(ctx, r.timeouts.Resolve)
+		defer cancel()
+		img, err := r.get(t, s)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			return nil, &RegistryError{Op: "get base image", Ref: s, Err: t.withStatus(err)}
+		}
+		bases[s] = img
+		return img, nil
+	}
+
+	var res ArchiveResult
+	out := map[name.Tag]v1.Image{}
+	for i, tags := range entries {
+		ai := ArchiveImage{}
+		if len(tags) == 0 {
+			// The vendored tarball package can neither select nor write
+			// an image without a tag.
+			if r.mismatch == MismatchFail {
+				return nil, fmt.Errorf("could not rebase image %d of archive %q: %w", i, src, ErrUntagged)
+			}
+			r.logger.Warn("image not rebased", "ref", tarballScheme+src, "image", i, "policy", r.mismatch.String(), "error", ErrUntagged)
+			ai.Mismatch = ErrUntagged
+			ai.Dropped = true
+			res.Images = append(res.Images, ai)
+			continue
+		}
+		for _, tag := range tags {
+			ai.Tags = append(ai.Tags, tag.String())
+		}
+		origStr := tarballScheme + src + ":" + ai.Tags[0]
+		orig, err := tarball.ImageFromPath(src, &tags[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not read %q: %w", origStr, err)
+		}
+
+		rebased, result, err := r.archiveImage(ctx, t, orig, origStr, oldBaseStr, newBaseStr, base)
+		var nerr *NotBasedOnError
+		var perr *PlatformMismatchError
+		switch {
+		case err == nil:
+			for _, tag := range ai.Tags {
+				result.References = append(result.References, tarballScheme+dst+":"+tag)
+			}
+			result.Reference = result.References[0]
+			ai.Result = result
+		case errors.As(err, &nerr) || errors.As(err, &perr) || errors.Is(err, ErrMissingLabel) || errors.Is(err, ErrMalformedLabel):
+			if r.mismatch == MismatchFail {
+				return nil, err
+			}
+			r.logger.Warn("image not rebased", "ref", origStr, "policy", r.mismatch.String(), "error", err)
+			ai.Mismatch = err
+			ai.Dropped = r.mismatch == MismatchDrop
+			rebased = orig
+		default:
+			return nil, err
+		}
+		if !ai.Dropped {
+			for _, tag := range tags {
+				out[tag] = rebased
+			}
+		}
+		res.Images = append(res.Images, ai)
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no image of archive %q is left to write", src)
+	}
+	pushCtx, cancel := t.phase(ctx, r.timeouts.Push)
+	defer cancel()
+	if err := writeArchive(dst, out); err != nil {
+		if ctxErr := pushCtx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		r.logger.Warn("write failed", "path", dst, "error", err)
+		return nil, fmt.Errorf("could not write new archive %q: %w", dst, err)
+	}
+	r.logger.Info("wrote archive", "path", dst, "images", len(res.Images))
+	return &res, nil
+}
+
+// archiveImage rebases orig, read from origStr, onto the given bases or
+// those named by its LABEL, obtaining the bases from base.
+func (r Rebaser) archiveImage(ctx context.Context, t *contextTransport, orig v1.Image, origStr, oldBaseStr, newBaseStr string, base func(string) (v1.Image, error)) (v1.Image, *Result, error) {
+	if oldBaseStr == "" && newBaseStr == "" {
+		cfg, err := orig.ConfigFile()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not get config for %q: %w", origStr, err)
+		}
+		if oldBaseStr, newBaseStr, err = r.basesFromLabel(cfg); err != nil {
+			return nil, nil, err
+		}
+	}
+	oldBase, err := base(oldBaseStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	newBase, err := base(newBaseStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.build(ctx, t, &inputs{
+		orig:       orig,
+		oldBase:    oldBase,
+		newBase:    newBase,
+		origStr:    origStr,
+		oldBaseStr: oldBaseStr,
+		newBaseStr: newBaseStr,
+	})
+}
+
+// readArchiveTags returns the tags of each image in the "docker save" archive
+// at path, in the order of its manifest.json. An untagged image has none.
+func readArchiveTags(path string, strictness name.Strictness) ([][]name.Tag, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("manifest.json not found in archive")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+
+		var descs []struct {
+			RepoTags []string
+		}
+		if err := json.NewDecoder(tr).Decode(&descs); err != nil {
+			return nil, err
+		}
+		entries := make([][]name.Tag, len(descs))
+		for i, desc := range descs {
+			for _, s := range desc.RepoTags {
+				tag, err := name.NewTag(s, strictness)
+				if err != nil {
+					return nil, err
+				}
+				entries[i] = append(entries[i], tag)
+			}
+		}
+		return entries, nil
+	}
+}
+
+// writeArchive writes a "docker save" archive like writeTarball. A file is
+// written to a temporary file first and renamed into place, since the images
+// may still be read from the file being replaced.
+func writeArchive(path string, tagToImage map[name.Tag]v1.Image) error {
+	if path == "-" {
+		return writeTarball(path, tagToImage)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := tarball.MultiWrite(tagToImage, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
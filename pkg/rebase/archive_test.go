@@ -0,0 +1,161 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// writeTestArchive writes images to a "docker save" archive and returns its
+// path.
+func writeTestArchive(t *testing.T, images ...savedImage) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "images.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := saveRecompressed(f, images...); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readArchiveImage reads the image tagged s from the archive at path.
+func readArchiveImage(t *testing.T, path, s string) (v1.Image, error) {
+	t.Helper()
+	tag, err := name.NewTag(s, name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := tarball.ImageFromPath(path, &tag)
+	if err != nil {
+		return nil, err
+	}
+	// Read the manifest, which fails if the tag is not in the archive.
+	_, err = img.Manifest()
+	return img, err
+}
+
+func TestRebaseArchive(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, _, newBase := reg.pushTestImages(t)
+	other, err := random.Image(64, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untagged, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := []savedImage{
+		{tags: []string{"app:1", "app:latest"}, img: orig},
+		{tags: []string{"other:1"}, img: other},
+		{img: untagged},
+	}
+
+	for _, tc := range []struct {
+		policy     MismatchPolicy
+		wantErr    error
+		keepsOther bool
+	}{
+		{policy: MismatchFail, wantErr: ErrNotBasedOn},
+		{policy: MismatchPassThrough, keepsOther: true},
+		{policy: MismatchDrop},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			src := writeTestArchive(t, images...)
+			dst := filepath.Join(t.TempDir(), "rebased.tar")
+			r := New(nil, nil, WithMismatchPolicy(tc.policy))
+			res, err := r.RebaseArchive(context.Background(), src, dst, reg.host+"/old:1", reg.host+"/new:1")
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("RebaseArchive() = %v, want %v", err, tc.wantErr)
+				}
+				if _, err := os.Stat(dst); !os.IsNotExist(err) {
+					t.Errorf("RebaseArchive() wrote %s", dst)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RebaseArchive() = %v", err)
+			}
+			if len(res.Images) != 3 {
+				t.Fatalf("RebaseArchive() described %d images, want 3", len(res.Images))
+			}
+
+			app := res.Images[0]
+			if app.Result == nil || app.Mismatch != nil || app.Dropped {
+				t.Errorf("app:1 = %+v, want it rebased", app)
+			}
+			for _, tag := range []string{"app:1", "app:latest"} {
+				img, err := readArchiveImage(t, dst, tag)
+				if err != nil {
+					t.Fatalf("%s is not in the new archive: %v", tag, err)
+				}
+				want := append(diffIDs(t, newBase), diffIDs(t, orig)[2:]...)
+				got := diffIDs(t, img)
+				if len(got) != len(want) || got[0] != want[0] || got[len(got)-1] != want[len(want)-1] {
+					t.Errorf("%s has diff IDs %v, want %v", tag, got, want)
+				}
+			}
+
+			o := res.Images[1]
+			var nerr *NotBasedOnError
+			if o.Result != nil || !errors.As(o.Mismatch, &nerr) || o.Dropped == tc.keepsOther {
+				t.Errorf("other:1 = %+v", o)
+			}
+			img, err := readArchiveImage(t, dst, "other:1")
+			if tc.keepsOther {
+				if err != nil {
+					t.Fatalf("other:1 is not in the new archive: %v", err)
+				}
+				if got, want := diffIDs(t, img), diffIDs(t, other); got[0] != want[0] || got[1] != want[1] {
+					t.Errorf("other:1 has diff IDs %v, want %v", got, want)
+				}
+			} else if err == nil {
+				t.Error("other:1 is still in the new archive")
+			}
+
+			u := res.Images[2]
+			if u.Tags != nil || u.Result != nil || u.Mismatch != ErrUntagged || !u.Dropped {
+				t.Errorf("untagged image = %+v, want it dropped with ErrUntagged", u)
+			}
+		})
+	}
+}
+
+func TestRebaseArchiveUntagged(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, _, _ := reg.pushTestImages(t)
+	src := writeTestArchive(t, savedImage{tags: []string{"app:1"}, img: orig}, savedImage{img: orig})
+	dst := filepath.Join(t.TempDir(), "rebased.tar")
+	_, err := New(nil, nil).RebaseArchive(context.Background(), src, dst, reg.host+"/old:1", reg.host+"/new:1")
+	if !errors.Is(err, ErrUntagged) {
+		t.Errorf("RebaseArchive() = %v, want ErrUntagged", err)
+	}
+}
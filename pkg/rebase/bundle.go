@@ -0,0 +1,468 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// bundleHeaderName is the name of the bundle's header in its archive. The
+// blobs are stored alongside it as blobs/<algorithm>/<hex>.
+const bundleHeaderName = "bundle.json"
+
+// bundleHeader describes the rebased image a bundle holds.
+type bundleHeader struct {
+	Original PinnedImage `json:"original"`
+	OldBase  PinnedImage `json:"oldBase"`
+	NewBase  PinnedImage `json:"newBase"`
+	// Manifest describes the manifest of the rebased image.
+	Manifest v1.Descriptor `json:"manifest"`
+	// Layers are the layers of the rebased image that the bundle holds.
+	// The others are layers of the original.
+	Layers []v1.Hash `json:"layers"`
+
+	KeptLayers    int `json:"keptLayers"`
+	RemovedLayers int `json:"removedLayers"`
+	AddedLayers   int `json:"addedLayers"`
+}
+
+// ExportBundle builds the image that Rebase would push and writes a bundle
+// of it to w, as a tar archive. The bundle holds the manifest and config of
+// the rebased image and those of its layers that the destination lacks,
+// which are usually the new base layers. It can be pushed with ImportBundle
+// to the destination.
+//
+// The destination is the first of rebased, which must all be in registries.
+// Its repository is asked which layers it already holds. If none is given,
+// or it cannot be reached, the bundle holds the layers that the original
+// lacks, and the destination must already hold the original. Checking the
+// destination and writing the bundle are bounded by the Push timeout.
+func (r Rebaser) ExportBundle(ctx context.Context, w io.Writer, origStr, oldBaseStr, newBaseStr string, rebasedStrs ...string) (*Result, error) {
+	dsts, err := r.bundleDestinations(rebasedStrs)
+	if err != nil {
+		return nil, err
+	}
+
+	t := r.roundTripper(ctx)
+	defer t.close()
+	in, err := r.resolve(ctx, t, origStr, oldBaseStr, newBaseStr)
+	if err != nil {
+		return nil, err
+	}
+	rebased, res, err := r.build(ctx, t, in)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := bundleHeader{
+		Original:      PinnedImage{Ref: in.origStr, Digest: res.Original},
+		OldBase:       PinnedImage{Ref: in.oldBaseStr, Digest: res.OldBase},
+		NewBase:       PinnedImage{Ref: in.newBaseStr, Digest: res.NewBase},
+		KeptLayers:    res.KeptLayers,
+		RemovedLayers: res.RemovedLayers,
+		AddedLayers:   res.AddedLayers,
+	}
+	if hdr.Manifest.MediaType, err = rebased.MediaType(); err != nil {
+		return nil, err
+	}
+	hdr.Manifest.Digest, hdr.Manifest.Size = res.Digest, res.ManifestSize
+
+	pushCtx, cancel := t.phase(ctx, r.timeouts.Push)
+	defer cancel()
+	layers, err := r.bundledLayers(t, in, rebased, dsts)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range layers {
+		hdr.Layers = append(hdr.Layers, d.Digest)
+	}
+
+	if err := writeBundle(w, hdr, rebased, layers); err != nil {
+		if ctxErr := pushCtx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		r.logger.Warn("write failed", "error", err)
+		return nil, fmt.Errorf("could not write bundle: %w", err)
+	}
+	r.logger.Info("wrote bundle", "digest", res.Digest.String(), "layers", len(layers))
+	return res, nil
+}
+
+// bundleDestinations parses the references a bundle is for, which must all
+// be in registries.
+func (r Rebaser) bundleDestinations(strs []string) ([]destination, error) {
+	if len(strs) == 0 {
+		return nil, nil
+	}
+	dsts, err := r.parseDestinations(strs)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dsts {
+		if !d.registry() {
+			return nil, fmt.Errorf("could not import bundle to %q: a bundle can only be imported into a registry", d.str)
+		}
+	}
+	return dsts, nil
+}
+
+// bundledLayers returns the layers of rebased that a bundle must hold: those
+// that the repository of the first of dsts lacks, or those that the
+// original lacks if there is no destination or it cannot be reached.
+func (r Rebaser) bundledLayers(t *contextTransport, in *inputs, rebased v1.Image, dsts []destination) ([]v1.Descriptor, error) {
+	have := map[v1.Hash]bool{}
+	checked := false
+	if len(dsts) > 0 {
+		existing, err := r.existingBlobs(t, dsts[0].repo, rebased)
+		if err != nil {
+			r.logger.Warn("could not check destination, bundling the layers the original lacks", "repo", dsts[0].repo.String(), "error", t.withStatus(err))
+		} else {
+			for _, h := range existing {
+				have[h] = true
+			}
+			checked = true
+		}
+	}
+	if !checked {
+		origManifest, err := in.orig.Manifest()
+		if err != nil {
+			return nil, &RegistryError{Op: "get manifest for original image", Ref: in.origStr, Err: t.withStatus(err)}
+		}
+		for _, d := range origManifest.Layers {
+			have[d.Digest] = true
+		}
+	}
+
+	m, err := rebased.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	var layers []v1.Descriptor
+	for _, d := range m.Layers {
+		if !have[d.Digest] {
+			have[d.Digest] = true
+			layers = append(layers, d)
+		}
+	}
+	return layers, nil
+}
+
+// writeBundle writes hdr, followed by the manifest and config of img and the
+// given layers, as a tar archive to w.
+func writeBundle(w io.Writer, hdr bundleHeader, img v1.Image, layers []v1.Descriptor) error {
+	tw := tar.NewWriter(w)
+	add := func(name string, size int64, r io.Reader) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: size, Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		n, err := io.Copy(tw, r)
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return fmt.Errorf("%s: wrote %d bytes, expected %d", name, n, size)
+		}
+		return nil
+	}
+
+	b, err := json.MarshalIndent(hdr, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := add(bundleHeaderName, int64(len(b)), bytes.NewReader(b)); err != nil {
+		return err
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	if err := add(bundleBlobName(hdr.Manifest.Digest), int64(len(raw)), bytes.NewReader(raw)); err != nil {
+		return err
+	}
+	cfgName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	cfg, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := add(bundleBlobName(cfgName), int64(len(cfg)), bytes.NewReader(cfg)); err != nil {
+		return err
+	}
+	for _, d := range layers {
+		l, err := img.LayerByDigest(d.Digest)
+		if err != nil {
+			return err
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			return err
+		}
+		err = add(bundleBlobName(d.Digest), d.Size, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// bundleBlobName returns the name of the blob h in a bundle.
+func bundleBlobName(h v1.Hash) string {
+	return path.Join("blobs", h.Algorithm, h.Hex)
+}
+
+// ImportBundle pushes the rebased image in the bundle at path, written by
+// ExportBundle, to each reference in rebased. The references must be in
+// registries. Layers that the bundle does not hold must already be in the
+// destination repository, or in the repository of the original if it is in
+// the same registry, from where they are mounted.
+func (r Rebaser) ImportBundle(ctx context.Context, path string, rebasedStrs ...string) (*Result, error) {
+	dsts, err := r.bundleDestinations(rebasedStrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(dsts) == 0 {
+		return nil, errors.New("no destination given for bundle")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, hdr, err := readBundle(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read bundle %q: %w", path, err)
+	}
+	res, err := hdr.result(img)
+	if err != nil {
+		return nil, fmt.Errorf("could not read bundle %q: %w", path, err)
+	}
+	if ref, ok := r.registryRef(hdr.Original.Ref); ok {
+		img = &mountableImage{Image: img, ref: ref}
+	}
+	r.logger.Info("read bundle", "path", path, "digest", res.Digest.String(), "layers", len(hdr.Layers))
+
+	t := r.roundTripper(ctx)
+	defer t.close()
+	return r.publish(ctx, t, img, res, dsts)
+}
+
+// registryRef parses s if it is a registry reference rather than one to an
+// archive, image layout, Docker Engine or registered source.
+func (r Rebaser) registryRef(s string) (name.Reference, bool) {
+	if src, _ := r.source(s); src != nil {
+		return nil, false
+	}
+	for _, scheme := range builtinSchemes {
+		if strings.HasPrefix(s, scheme) {
+			return nil, false
+		}
+	}
+	ref, err := name.ParseReference(s, r.strictness)
+	return ref, err == nil
+}
+
+// result returns the Result of the rebase that produced img, the image in
+// the bundle h describes.
+func (h bundleHeader) result(img v1.Image) (*Result, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Digest:        h.Manifest.Digest,
+		Original:      h.Original.Digest,
+		OldBase:       h.OldBase.Digest,
+		NewBase:       h.NewBase.Digest,
+		KeptLayers:    h.KeptLayers,
+		RemovedLayers: h.RemovedLayers,
+		AddedLayers:   h.AddedLayers,
+		ManifestSize:  h.Manifest.Size,
+		ConfigSize:    m.Config.Size,
+	}
+	for _, l := range m.Layers {
+		res.LayersSize += l.Size
+	}
+	return res, nil
+}
+
+// readBundle indexes the bundle in f and returns the image it holds. The
+// blobs are read from f when they are needed.
+func readBundle(f *os.File) (v1.Image, *bundleHeader, error) {
+	// Read f through a plain io.Reader, so that the tar reader does not
+	// seek past entries, and the offset of every entry is known.
+	cr := &countingReader{Reader: f}
+	tr := tar.NewReader(cr)
+	blobs := map[string]*io.SectionReader{}
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if th.Typeflag == tar.TypeReg {
+			blobs[th.Name] = io.NewSectionReader(f, cr.n, th.Size)
+		}
+	}
+
+	sr, ok := blobs[bundleHeaderName]
+	if !ok {
+		return nil, nil, fmt.Errorf("%s not found in bundle", bundleHeaderName)
+	}
+	var hdr bundleHeader
+	if err := json.NewDecoder(sr).Decode(&hdr); err != nil {
+		return nil, nil, err
+	}
+
+	raw, err := readBundleBlob(blobs, hdr.Manifest.Digest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read manifest: %w", err)
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := readBundleBlob(blobs, m.Config.Digest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read config: %w", err)
+	}
+	for _, h := range hdr.Layers {
+		if _, ok := blobs[bundleBlobName(h)]; !ok {
+			return nil, nil, fmt.Errorf("layer %s not found in bundle", h)
+		}
+	}
+
+	img, err := partial.CompressedToImage(&bundleImage{
+		mediaType: hdr.Manifest.MediaType,
+		manifest:  raw,
+		config:    cfg,
+		blobs:     blobs,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, &hdr, nil
+}
+
+// readBundleBlob reads the blob h from blobs and verifies its digest.
+func readBundleBlob(blobs map[string]*io.SectionReader, h v1.Hash) ([]byte, error) {
+	sr, ok := blobs[bundleBlobName(h)]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found in bundle", h)
+	}
+	b, err := ioutil.ReadAll(sr)
+	if err != nil {
+		return nil, err
+	}
+	got, _, err := v1.SHA256(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if got != h {
+		return nil, fmt.Errorf("blob %s has digest %s", h, got)
+	}
+	return b, nil
+}
+
+// errNotInBundle is returned when a layer of a bundled image is read that the
+// bundle does not hold.
+var errNotInBundle = errors.New("layer is not in the bundle and must already be in the registry")
+
+// bundleImage implements partial.CompressedImageCore
+type bundleImage struct {
+	mediaType types.MediaType
+	manifest  []byte
+	config    []byte
+	blobs     map[string]*io.SectionReader
+}
+
+// MediaType implements partial.CompressedImageCore
+func (i *bundleImage) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+// RawManifest implements partial.CompressedImageCore
+func (i *bundleImage) RawManifest() ([]byte, error) {
+	return i.manifest, nil
+}
+
+// RawConfigFile implements partial.CompressedImageCore
+func (i *bundleImage) RawConfigFile() ([]byte, error) {
+	return i.config, nil
+}
+
+// LayerByDigest implements partial.CompressedImageCore
+func (i *bundleImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	return &bundleLayer{img: i, digest: h}, nil
+}
+
+// bundleLayer implements partial.CompressedLayer
+type bundleLayer struct {
+	img    *bundleImage
+	digest v1.Hash
+}
+
+// Digest implements partial.CompressedLayer
+func (l *bundleLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+// Compressed implements partial.CompressedLayer
+func (l *bundleLayer) Compressed() (io.ReadCloser, error) {
+	sr, ok := l.img.blobs[bundleBlobName(l.digest)]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", l.digest, errNotInBundle)
+	}
+	return ioutil.NopCloser(io.NewSectionReader(sr, 0, sr.Size())), nil
+}
+
+// Size implements partial.CompressedLayer
+func (l *bundleLayer) Size() (int64, error) {
+	m, err := partial.Manifest(l.img)
+	if err != nil {
+		return 0, err
+	}
+	if m.Config.Digest == l.digest {
+		return m.Config.Size, nil
+	}
+	for _, desc := range m.Layers {
+		if desc.Digest == l.digest {
+			return desc.Size, nil
+		}
+	}
+	return 0, fmt.Errorf("blob %v not found in manifest", l.digest)
+}
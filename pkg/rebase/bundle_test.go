@@ -0,0 +1,230 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// exportTestBundle exports the rebase of the test images in reg, for dsts,
+// to a file and returns its path.
+func exportTestBundle(t *testing.T, reg *testRegistry, dsts ...string) (string, *Result) {
+	t.Helper()
+	var b bytes.Buffer
+	res, err := New(nil, nil).ExportBundle(context.Background(), &b, reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", dsts...)
+	if err != nil {
+		t.Fatalf("ExportBundle() = %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "bundle.tar")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, res
+}
+
+func TestReadBundle(t *testing.T) {
+	reg := newTestRegistry(t)
+	_, _, newBase := reg.pushTestImages(t)
+	path, res := exportTestBundle(t, reg)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, hdr, err := readBundle(f)
+	if err != nil {
+		t.Fatalf("readBundle() = %v", err)
+	}
+	if got := mustDigest(t, img); got != res.Digest {
+		t.Errorf("bundled image has digest %s, want %s", got, res.Digest)
+	}
+
+	// The bundle holds exactly the new base layers, and each is read from
+	// the right offset of the archive.
+	newLayers, err := newBase.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr.Layers) != len(newLayers) {
+		t.Fatalf("bundle holds %d layers, want %d", len(hdr.Layers), len(newLayers))
+	}
+	for i, l := range newLayers {
+		want := mustLayerDigest(t, l)
+		if hdr.Layers[i] != want {
+			t.Errorf("bundled layer %d = %s, want %s", i, hdr.Layers[i], want)
+		}
+		bl, err := img.LayerByDigest(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := bl.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := v1.SHA256(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("bundled layer %s reads as %s", want, got)
+		}
+	}
+}
+
+// bundledLayers returns the layers held by the bundle at path.
+func bundledLayers(t *testing.T, path string) []v1.Hash {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, hdr, err := readBundle(f)
+	if err != nil {
+		t.Fatalf("readBundle() = %v", err)
+	}
+	return hdr.Layers
+}
+
+func TestExportBundleDestination(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, _, newBase := reg.pushTestImages(t)
+	ls, err := newBase.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The destination, in another registry, already has the first new
+	// base layer, and the bundle holds the rest of the rebased image's.
+	dst := newTestRegistry(t)
+	rc, err := ls[0].Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.blobs[digestOf(b)] = b
+	path, _ := exportTestBundle(t, reg, dst.host+"/out:1")
+
+	var want []v1.Hash
+	for _, l := range ls[1:] {
+		want = append(want, mustLayerDigest(t, l))
+	}
+	want = append(want, layerDigest(t, orig, 2))
+	got := bundledLayers(t, path)
+	if len(got) != len(want) {
+		t.Fatalf("bundle holds %d layers, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("bundled layer %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestExportBundleUnreachableDestination(t *testing.T) {
+	reg := newTestRegistry(t)
+	_, _, newBase := reg.pushTestImages(t)
+	ls, err := newBase.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A destination that cannot be reached is assumed to have the original.
+	path, _ := exportTestBundle(t, reg, "127.0.0.1:1/out:1")
+	if got := bundledLayers(t, path); len(got) != len(ls) {
+		t.Errorf("bundle holds %d layers, want the %d new base layers", len(got), len(ls))
+	}
+}
+
+func TestExportBundleNotRegistry(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	var b bytes.Buffer
+	if _, err := New(nil, nil).ExportBundle(context.Background(), &b, reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", "oci:"+t.TempDir()); err == nil {
+		t.Error("ExportBundle() to an image layout succeeded, want an error")
+	}
+}
+
+func TestImportBundle(t *testing.T) {
+	reg := newTestRegistry(t)
+	_, _, newBase := reg.pushTestImages(t)
+	path, exported := exportTestBundle(t, reg)
+
+	// The bundle is for a registry that does not have the new base.
+	ls, err := newBase.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.mu.Lock()
+	for _, l := range ls {
+		delete(reg.blobs, mustLayerDigest(t, l).String())
+	}
+	reg.mu.Unlock()
+
+	res, err := New(nil, nil).ImportBundle(context.Background(), path, reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("ImportBundle() = %v", err)
+	}
+	if res.Digest != exported.Digest || res.Original != exported.Original || res.AddedLayers != exported.AddedLayers {
+		t.Errorf("ImportBundle() = %+v, want the result of ExportBundle, %+v", res, exported)
+	}
+	if !reg.has("out", "1") || !reg.has("out", res.Digest.String()) {
+		t.Error("rebased image was not pushed to out:1")
+	}
+	// The kept layer is mounted from the original rather than uploaded.
+	if n := reg.count("PATCH", "/v2/out/blobs/uploads/"); n != 4 {
+		t.Errorf("uploaded %d blobs, want 4, the config and the new base layers", n)
+	}
+}
+
+func TestReadBundleTampered(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	path, res := exportTestBundle(t, reg)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(b, []byte(`"schemaVersion"`))
+	if i < 0 || i < bytes.Index(b, []byte(res.Digest.Hex)) {
+		t.Fatal("could not find the manifest in the bundle")
+	}
+	b[i+1] = 'S'
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(nil, nil).ImportBundle(context.Background(), path, reg.host+"/out:1"); err == nil {
+		t.Error("ImportBundle() succeeded with a modified manifest")
+	}
+	if reg.has("out", "1") {
+		t.Error("out:1 was pushed from a modified bundle")
+	}
+}
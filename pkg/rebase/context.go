@@ -0,0 +1,162 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeouts bounds the individual phases of a rebase. A zero duration means
+// the phase is bounded only by the context passed to RebaseContext.
+type Timeouts struct {
+	// Resolve bounds fetching the original, old base and new base images.
+	Resolve time.Duration
+	// Validate bounds checking that the old base is a prefix of the
+	// original and constructing the rebased image.
+	Validate time.Duration
+	// Push bounds uploading the rebased image.
+	Push time.Duration
+}
+
+// contextTransport binds every outgoing request to the context of the
+// current phase, since the vendored remote package does not accept one.
+//
+// Images read from a registry fetch configs and blobs lazily, so the
+// context is swapped between phases rather than fixed at construction.
+//
+// It also records the status of the last error response whose body was
+// read, which is what transport.CheckError does before it returns an error,
+// so that errors can be classified by status rather than by message.
+type contextTransport struct {
+	inner http.RoundTripper
+	// parent, if set, holds the phase context and status instead.
+	parent *contextTransport
+
+	mu     sync.Mutex
+	ctx    context.Context
+	status int
+	// daemon is the Docker Engine API client, built on first use.
+	daemon *http.Client
+	// cleanups release what the rebase holds once it is over.
+	cleanups []func()
+}
+
+func newContextTransport(ctx context.Context, inner http.RoundTripper) *contextTransport {
+	return &contextTransport{inner: inner, ctx: ctx}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req.WithContext(t.context()))
+	if err == nil && resp.StatusCode >= 400 {
+		resp.Body = &statusBody{ReadCloser: resp.Body, t: t.root(), status: resp.StatusCode}
+	}
+	return resp, err
+}
+
+// root returns the transport that holds the phase context and status.
+func (t *contextTransport) root() *contextTransport {
+	if t.parent != nil {
+		return t.parent.root()
+	}
+	return t
+}
+
+// withStatus attaches the recorded status, if any, to err, and clears it.
+func (t *contextTransport) withStatus(err error) error {
+	t = t.root()
+	t.mu.Lock()
+	status := t.status
+	t.status = 0
+	t.mu.Unlock()
+	if err == nil || status == 0 || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &statusError{status: status, err: err}
+}
+
+// statusBody records the status of an error response once its body has
+// been read to the end.
+type statusBody struct {
+	io.ReadCloser
+	t      *contextTransport
+	status int
+}
+
+// Read implements io.Reader
+func (b *statusBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.t.mu.Lock()
+		b.t.status = b.status
+		b.t.mu.Unlock()
+	}
+	return n, err
+}
+
+// onClose arranges for f to be called by close.
+func (t *contextTransport) onClose(f func()) {
+	t = t.root()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cleanups = append(t.cleanups, f)
+}
+
+// close releases the spooled files and idle connections of the rebase. No
+// image read through t may be used afterwards.
+func (t *contextTransport) close() {
+	t = t.root()
+	t.mu.Lock()
+	cleanups := t.cleanups
+	t.cleanups = nil
+	t.mu.Unlock()
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
+
+// bind returns a transport that sends requests through inner, bound to the
+// same phase contexts as t.
+func (t *contextTransport) bind(inner http.RoundTripper) http.RoundTripper {
+	return &contextTransport{inner: inner, parent: t}
+}
+
+func (t *contextTransport) context() context.Context {
+	t = t.root()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ctx
+}
+
+// phase scopes subsequent requests to ctx, bounded by d if it is positive.
+// The returned function must be called when the phase is over.
+func (t *contextTransport) phase(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	cancel := func() {}
+	if d > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d)
+	}
+	t.mu.Lock()
+	t.ctx = ctx
+	t.status = 0
+	t.mu.Unlock()
+	return ctx, cancel
+}
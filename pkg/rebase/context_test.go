@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newStallingRegistry returns the host of a registry that answers no request
+// until the request is cancelled.
+func newStallingRegistry(t *testing.T) string {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+func TestRebaseContextResolveTimeout(t *testing.T) {
+	host := newStallingRegistry(t)
+	r := New(nil, nil, WithTimeouts(Timeouts{Resolve: 50 * time.Millisecond}))
+	start := time.Now()
+	_, err := r.RebaseContext(context.Background(), host+"/app:1", host+"/old:1", host+"/new:1", host+"/out:1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RebaseContext() = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("RebaseContext() took %s, want it bounded by the Resolve timeout", d)
+	}
+}
+
+func TestRebaseContextPushTimeout(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	host := newStallingRegistry(t)
+	r := New(nil, nil, WithTimeouts(Timeouts{Push: 50 * time.Millisecond}))
+	_, err := r.RebaseContext(context.Background(), reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", host+"/out:1")
+	var rerr *RegistryError
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &rerr) || !rerr.push {
+		t.Errorf("RebaseContext() = %v, want a push that failed with context.DeadlineExceeded", err)
+	}
+}
+
+func TestRebaseContextCancelled(t *testing.T) {
+	host := newStallingRegistry(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := New(nil, nil).RebaseContext(ctx, host+"/app:1", host+"/old:1", host+"/new:1", host+"/out:1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RebaseContext() = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// daemonScheme prefixes references to images in a Docker Engine, in the form
+// docker-daemon:<reference>.
+const daemonScheme = "docker-daemon:"
+
+// defaultDockerHost is the Docker Engine API socket used unless DOCKER_HOST
+// names a unix socket or WithDockerHost is given.
+const defaultDockerHost = "/var/run/docker.sock"
+
+// WithDockerHost sets the path of the unix socket on which the Docker Engine
+// API serves docker-daemon: references.
+func WithDockerHost(socket string) Option {
+	return func(r *Rebaser) {
+		r.dockerHost = socket
+	}
+}
+
+// daemonClient returns a client for the Docker Engine API, whose requests are
+// bound to the same phase contexts as t. The client is shared by the whole
+// rebase, and its idle connections are closed along with t.
+func (r Rebaser) daemonClient(t *contextTransport) *http.Client {
+	t = t.root()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.daemon != nil {
+		return t.daemon
+	}
+	socket := r.dockerHost
+	if socket == "" {
+		socket = defaultDockerHost
+		if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+			socket = strings.TrimPrefix(host, "unix://")
+		}
+	}
+	var d net.Dialer
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	t.daemon = &http.Client{Transport: t.bind(tr)}
+	t.cleanups = append(t.cleanups, tr.CloseIdleConnections)
+	return t.daemon
+}
+
+// daemonURL returns the URL of an Engine API endpoint. The host is ignored,
+// since requests are dialed to the socket.
+func daemonURL(path string, query url.Values) string {
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// daemonImage exports s from the Docker Engine with /images/get.
+//
+// The exported archive is spooled to an unlinked temporary file, since its
+// layers are read more than once. The file is closed along with t.
+func (r Rebaser) daemonImage(t *contextTransport, s string) (v1.Image, error) {
+	ref, err := name.ParseReference(s, r.strictness)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.daemonClient(t).Get(daemonURL("/images/get", url.Values{"names": {s}}))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkDaemonError(resp); err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "rebase-docker-daemon-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	t.onClose(func() { f.Close() })
+	n, err := io.Copy(f, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	opener := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(f, 0, n)), nil
+	}
+
+	// An image exported by digest carries no tag to select it by, but is
+	// then the only image in the archive.
+	var tag *name.Tag
+	if t, ok := ref.(name.Tag); ok {
+		tag = &t
+	}
+	return tarball.Image(opener, tag)
+}
+
+// writeDaemon loads img into the Docker Engine under tag with /images/load.
+func (r Rebaser) writeDaemon(t *contextTransport, tag name.Tag, img v1.Image) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarball.Write(tag, img, pw))
+	}()
+	defer pr.Close()
+
+	resp, err := r.daemonClient(t).Post(daemonURL("/images/load", url.Values{"quiet": {"1"}}), "application/x-tar", pr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkDaemonError(resp); err != nil {
+		return err
+	}
+
+	// The Engine reports failures to load as part of a stream of JSON
+	// messages, after a successful status.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
+}
+
+// checkDaemonError returns the error carried by an unsuccessful Engine API
+// response.
+func checkDaemonError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var body struct {
+		Message string `json:"message"`
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	msg := string(b)
+	if json.Unmarshal(b, &body) == nil && body.Message != "" {
+		msg = body.Message
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, msg)
+	}
+	return fmt.Errorf("docker daemon returned status %d: %s", resp.StatusCode, msg)
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// testDaemon stands in for the Docker Engine API on a unix socket. Like the
+// Engine, it exports images with their layers compressed afresh, so they do
+// not have the digests they have in a registry.
+type testDaemon struct {
+	socket string
+
+	mu     sync.Mutex
+	images map[string]v1.Image
+	// conns counts the connections accepted.
+	conns int
+}
+
+func newTestDaemon(t *testing.T) *testDaemon {
+	t.Helper()
+	d := &testDaemon{
+		socket: filepath.Join(t.TempDir(), "docker.sock"),
+		images: map[string]v1.Image{},
+	}
+	l, err := net.Listen("unix", d.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewUnstartedServer(d)
+	s.Listener = l
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			d.mu.Lock()
+			d.conns++
+			d.mu.Unlock()
+		}
+	}
+	s.Start()
+	t.Cleanup(s.Close)
+	return d
+}
+
+// daemonKey normalizes s the way the Engine resolves image names.
+func daemonKey(s string) string {
+	ref, err := name.ParseReference(s, name.WeakValidation)
+	if err != nil {
+		return s
+	}
+	return ref.Name()
+}
+
+func (d *testDaemon) image(s string) (v1.Image, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	img, ok := d.images[daemonKey(s)]
+	return img, ok
+}
+
+func (d *testDaemon) add(s string, img v1.Image) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.images[daemonKey(s)] = img
+}
+
+// ServeHTTP implements http.Handler
+func (d *testDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/images/get":
+		s := r.URL.Query().Get("names")
+		img, ok := d.image(s)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"message":"reference does not exist: %s"}`, s)
+			return
+		}
+		if err := saveRecompressed(w, savedImage{tags: []string{s}, img: img}); err != nil {
+			panic(err)
+		}
+	case "/images/load":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		tags, err := archiveRepoTags(b)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"message":%q}`, err.Error())
+			return
+		}
+		img, err := tarball.Image(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}, nil)
+		if err != nil {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, `{"error":%q}`, err.Error())
+			return
+		}
+		for _, tag := range tags {
+			d.add(tag, img)
+		}
+		fmt.Fprintf(w, `{"stream":"Loaded image: %s\n"}`, tags[0])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// savedImage is an image of a "docker save" archive and its tags, which may
+// be none.
+type savedImage struct {
+	tags []string
+	img  v1.Image
+}
+
+// saveRecompressed writes images to w as a "docker save" archive, with every
+// layer compressed at another level than the vendored packages use.
+func saveRecompressed(w io.Writer, images ...savedImage) error {
+	tw := tar.NewWriter(w)
+	add := func(path string, b []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: path, Size: int64(len(b)), Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	type entry struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	var m []entry
+	for i, si := range images {
+		cfg, err := si.img.RawConfigFile()
+		if err != nil {
+			return err
+		}
+		ls, err := si.img.Layers()
+		if err != nil {
+			return err
+		}
+		e := entry{Config: fmt.Sprintf("%d.json", i), RepoTags: si.tags}
+		if err := add(e.Config, cfg); err != nil {
+			return err
+		}
+		for j, l := range ls {
+			rc, err := l.Uncompressed()
+			if err != nil {
+				return err
+			}
+			var b bytes.Buffer
+			zw, _ := gzip.NewWriterLevel(&b, gzip.BestCompression)
+			_, err = io.Copy(zw, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			path := fmt.Sprintf("%d/%d/layer.tar.gz", i, j)
+			if err := add(path, b.Bytes()); err != nil {
+				return err
+			}
+			e.Layers = append(e.Layers, path)
+		}
+		m = append(m, e)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := add("manifest.json", b); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// archiveRepoTags returns the tags of the images in a "docker save" archive.
+func archiveRepoTags(b []byte) ([]string, error) {
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("archive has no manifest.json")
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+		var m []struct{ RepoTags []string }
+		if err := json.NewDecoder(tr).Decode(&m); err != nil {
+			return nil, err
+		}
+		var tags []string
+		for _, d := range m {
+			tags = append(tags, d.RepoTags...)
+		}
+		if len(tags) == 0 {
+			return nil, errors.New("archive has no tags")
+		}
+		return tags, nil
+	}
+}
+
+func diffIDs(t *testing.T, img v1.Image) []v1.Hash {
+	t.Helper()
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.RootFS.DiffIDs
+}
+
+func TestDaemonRebase(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, oldBase, newBase := testImages(t)
+	reg.push(t, "old:1", oldBase)
+	reg.push(t, "new:1", newBase)
+	d := newTestDaemon(t)
+	d.add("app:1", orig)
+
+	r := New(nil, nil, WithDockerHost(d.socket))
+	tr := r.roundTripper(context.Background())
+	defer tr.close()
+	exported, err := r.daemonImage(tr, "app:1")
+	if err != nil {
+		t.Fatalf("daemonImage() = %v", err)
+	}
+	if mustDigest(t, exported) == mustDigest(t, orig) {
+		t.Fatal("exported image has the digest of the original; the stand-in should recompress its layers")
+	}
+
+	if _, err := r.Rebase(daemonScheme+"app:1", reg.host+"/old:1", reg.host+"/new:1", daemonScheme+"app:2"); err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	rebased, ok := d.image("app:2")
+	if !ok {
+		t.Fatal("rebased image was not loaded as app:2")
+	}
+	want := append(diffIDs(t, newBase), diffIDs(t, orig)[2:]...)
+	got := diffIDs(t, rebased)
+	if len(got) != len(want) {
+		t.Fatalf("rebased diff IDs = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("rebased diff ID %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDaemonSharesConnection(t *testing.T) {
+	orig, oldBase, newBase := testImages(t)
+	d := newTestDaemon(t)
+	d.add("app:1", orig)
+	d.add("old:1", oldBase)
+	d.add("new:1", newBase)
+
+	r := New(nil, nil, WithDockerHost(d.socket))
+	if _, err := r.Rebase(daemonScheme+"app:1", daemonScheme+"old:1", daemonScheme+"new:1", daemonScheme+"app:2"); err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	if _, ok := d.image("app:2"); !ok {
+		t.Fatal("rebased image was not loaded as app:2")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conns != 1 {
+		t.Errorf("daemon accepted %d connections, want 1", d.conns)
+	}
+}
+
+func TestDaemonNotFound(t *testing.T) {
+	d := newTestDaemon(t)
+	_, err := New(nil, nil, WithDockerHost(d.socket)).Rebase(daemonScheme+"app:1", daemonScheme+"old:1", daemonScheme+"new:1", daemonScheme+"app:2")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rebase() = %v, want ErrNotFound", err)
+	}
+}
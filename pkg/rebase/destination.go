@@ -0,0 +1,259 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// errNoDestination is returned when a rebase is given nowhere to push to.
+var errNoDestination = errors.New("no destination given for rebased image")
+
+// destination is a place the rebased image is pushed to.
+type destination struct {
+	str string
+	// tarball is the path of the archive to write, or "-" for stdout, if
+	// the destination is a "docker save" archive rather than a registry.
+	tarball string
+	// layout is the image layout to write to, if the destination is one.
+	layout *layoutRef
+	// daemon is set if the destination is a Docker Engine.
+	daemon bool
+	// sink is the registered sink for the destination, if any, under
+	// scheme. rest is the reference without the scheme.
+	sink   ImageSink
+	scheme string
+	rest   string
+	repo   name.Repository
+	// ref is the tag or digest to push to. It is nil for a repository-only
+	// destination, which is pushed to by the rebased image's digest.
+	ref name.Reference
+}
+
+// parseDestinations parses the references a rebased image is pushed to. A
+// reference without a tag or digest is pushed to by digest. A reference of
+// the form tarball:<path>:<tag> is written to a "docker save" archive
+// instead, which is written to stdout if path is "-". A reference with the
+// scheme of a sink registered with WithSink is left to that sink.
+func (r Rebaser) parseDestinations(strs []string) ([]destination, error) {
+	if len(strs) == 0 {
+		return nil, errNoDestination
+	}
+	dsts := make([]destination, 0, len(strs))
+	for _, s := range strs {
+		var d destination
+		var err error
+		switch scheme, rest, ok := r.sink(s); {
+		case ok:
+			d.sink, d.scheme, d.rest = r.sinks[scheme], scheme, rest
+		case strings.HasPrefix(s, tarballScheme):
+			var tag *name.Tag
+			d.tarball, tag, err = r.splitTarballRef(strings.TrimPrefix(s, tarballScheme))
+			if err == nil && tag == nil {
+				err = errors.New("a tarball destination needs a tag")
+			}
+			if tag != nil {
+				d.ref = *tag
+			}
+		case strings.HasPrefix(s, layoutScheme):
+			var l layoutRef
+			l, err = parseLayoutRef(strings.TrimPrefix(s, layoutScheme))
+			if err == nil && l.digest != nil {
+				err = errors.New("an image layout destination cannot select a manifest by digest")
+			}
+			d.layout = &l
+		case strings.HasPrefix(s, daemonScheme):
+			var tag name.Tag
+			tag, err = name.NewTag(strings.TrimPrefix(s, daemonScheme), r.strictness)
+			d.ref, d.daemon = tag, true
+		case strings.Contains(s, "@"):
+			var dgst name.Digest
+			dgst, err = name.NewDigest(s, r.strictness)
+			d.ref, d.repo = dgst, dgst.Context()
+		case strings.LastIndex(s, ":") > strings.LastIndex(s, "/"):
+			var tag name.Tag
+			tag, err = name.NewTag(s, r.strictness)
+			d.ref, d.repo = tag, tag.Context()
+		default:
+			d.repo, err = name.NewRepository(s, r.strictness)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse rebased reference %q: %w", s, err)
+		}
+		d.str = s
+		dsts = append(dsts, d)
+	}
+	return dsts, nil
+}
+
+// registry reports whether d is pushed to a registry.
+func (d destination) registry() bool {
+	return d.sink == nil && d.tarball == "" && d.layout == nil && !d.daemon
+}
+
+// resolve returns the reference d describes for an image with digest h.
+func (d destination) resolve(h v1.Hash) (name.Reference, error) {
+	if d.ref == nil {
+		return name.NewDigest(fmt.Sprintf("%s@%s", d.repo, h), name.StrictValidation)
+	}
+	if dgst, ok := d.ref.(name.Digest); ok && dgst.DigestStr() != h.String() {
+		return nil, fmt.Errorf("rebased image has digest %s, not %s", h, dgst.DigestStr())
+	}
+	return d.ref, nil
+}
+
+// name returns how ref, as resolved from d, is reported to callers.
+func (d destination) name(ref name.Reference) string {
+	if d.tarball != "" {
+		return tarballScheme + d.tarball + ":" + ref.String()
+	}
+	if d.daemon {
+		return daemonScheme + ref.String()
+	}
+	return ref.String()
+}
+
+// push uploads img to every destination. Its blobs are written once per
+// repository, after which further tags in that repository only receive the
+// manifest. Each archive is written once, with all of its tags. It returns
+// the references img was pushed to.
+func (r Rebaser) push(t *contextTransport, img v1.Image, dsts []destination) ([]string, error) {
+	h, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]string, len(dsts))
+	written := map[name.Repository]*http.Client{}
+	archives := map[string]map[name.Tag]v1.Image{}
+	var paths []string
+	for i, d := range dsts {
+		if d.sink != nil {
+			continue
+		}
+		if d.layout != nil {
+			if err := writeLayout(*d.layout, img); err != nil {
+				r.logger.Warn("write failed", "ref", d.str, "error", err)
+				return nil, fmt.Errorf("could not write new image to %q: %w", d.str, err)
+			}
+			r.logger.Info("wrote image", "ref", d.layout.String(), "digest", h.String())
+			refs[i] = d.layout.String()
+			continue
+		}
+		ref, err := d.resolve(h)
+		if err != nil {
+			return nil, &RegistryError{Op: "put new image", Ref: d.str, Err: err, push: true}
+		}
+		refs[i] = d.name(ref)
+		if d.daemon {
+			if err := r.writeDaemon(t, ref.(name.Tag), img); err != nil {
+				r.logger.Warn("load failed", "ref", refs[i], "error", err)
+				return nil, fmt.Errorf("could not load new image %q: %w", d.str, err)
+			}
+			r.logger.Info("loaded image", "ref", refs[i], "digest", h.String())
+			continue
+		}
+		if d.tarball != "" {
+			if archives[d.tarball] == nil {
+				archives[d.tarball] = map[name.Tag]v1.Image{}
+				paths = append(paths, d.tarball)
+			}
+			archives[d.tarball][ref.(name.Tag)] = img
+			continue
+		}
+		if client, ok := written[d.repo]; ok {
+			// The blobs are already in this repository. A digest reference
+			// needs nothing more, since the manifest was put by digest
+			// along with the first reference.
+			if _, ok := ref.(name.Tag); ok {
+				p := r.newProgress(ref.String())
+				p.report(ProgressEvent{Kind: ManifestPushing, Digest: h})
+				if err := putManifest(client, ref, raw, mt); err != nil {
+					r.logger.Warn("push failed", "ref", ref.String(), "error", err)
+					return nil, &RegistryError{Op: "tag new image", Ref: d.str, Err: t.withStatus(err), push: true}
+				}
+				p.report(ProgressEvent{Kind: ManifestCommitted, Digest: h})
+			}
+			r.logger.Info("pushed image", "ref", ref.String(), "digest", h.String())
+			continue
+		}
+
+		a, err := r.keychain.Resolve(d.repo.Registry)
+		if err != nil {
+			return nil, &RegistryError{Op: "authorize to", Ref: d.repo.RegistryStr(), Err: fmt.Errorf("%w: %v", ErrUnauthorized, err)}
+		}
+		p := r.newProgress(ref.String())
+		if err := remote.Write(ref, p.image(img), a, p.transport(t, h)); err != nil {
+			r.logger.Warn("push failed", "ref", ref.String(), "error", err)
+			return nil, &RegistryError{Op: "put new image", Ref: d.str, Err: t.withStatus(err), push: true}
+		}
+		r.logger.Info("pushed image", "ref", ref.String(), "digest", h.String())
+		client, err := r.client(t, d.repo, transport.PushScope)
+		if err != nil {
+			return nil, err
+		}
+		written[d.repo] = client
+	}
+
+	for _, path := range paths {
+		if err := writeTarball(path, archives[path]); err != nil {
+			r.logger.Warn("write failed", "path", path, "error", err)
+			return nil, fmt.Errorf("could not write new image to %q: %w", path, err)
+		}
+		r.logger.Info("wrote image", "path", path, "digest", h.String())
+	}
+	if err := r.writeSinks(t, img, dsts, refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// putManifest puts the raw manifest of media type mt at ref.
+func putManifest(client *http.Client, ref name.Reference, raw []byte, mt types.MediaType) error {
+	u := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", ref.Context().Registry.Scheme(), ref.Context().RegistryStr(), ref.Context().RepositoryStr(), ref.Identifier())
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(mt))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return transport.CheckError(resp, http.StatusOK, http.StatusCreated, http.StatusAccepted)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestParseDestinations(t *testing.T) {
+	r := New(nil, nil)
+	for _, test := range []struct {
+		in      string
+		wantRef string
+		repo    string
+		tarball string
+		wantErr bool
+	}{
+		{in: "gcr.io/foo/bar:baz", wantRef: "gcr.io/foo/bar:baz", repo: "gcr.io/foo/bar"},
+		{in: "gcr.io/foo/bar@sha256:" + zeros, wantRef: "gcr.io/foo/bar@sha256:" + zeros, repo: "gcr.io/foo/bar"},
+		{in: "gcr.io/foo/bar", repo: "gcr.io/foo/bar"},
+		{in: "localhost:5000/bar", repo: "localhost:5000/bar"},
+		{in: "localhost:5000/bar:v1", wantRef: "localhost:5000/bar:v1", repo: "localhost:5000/bar"},
+		{in: "tarball:out.tar:bar:v1", wantRef: "index.docker.io/library/bar:v1", tarball: "out.tar"},
+		{in: "tarball:out.tar", wantErr: true},
+		{in: "gcr.io/foo/bar@sha256:123", wantErr: true},
+		{in: "gcr.io/FOO", wantErr: true},
+	} {
+		t.Run(test.in, func(t *testing.T) {
+			dsts, err := r.parseDestinations([]string{test.in})
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseDestinations(%q) = %+v, want error", test.in, dsts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDestinations(%q) = %v", test.in, err)
+			}
+			d := dsts[0]
+			if d.str != test.in {
+				t.Errorf("str = %q, want %q", d.str, test.in)
+			}
+			gotRef := ""
+			if d.ref != nil {
+				gotRef = d.ref.Name()
+			}
+			if gotRef != test.wantRef {
+				t.Errorf("ref = %q, want %q", gotRef, test.wantRef)
+			}
+			if test.repo != "" && d.repo.String() != test.repo {
+				t.Errorf("repo = %q, want %q", d.repo, test.repo)
+			}
+			if d.tarball != test.tarball {
+				t.Errorf("tarball = %q, want %q", d.tarball, test.tarball)
+			}
+			if d.registry() != (test.tarball == "") {
+				t.Errorf("registry() = %t", d.registry())
+			}
+		})
+	}
+
+	if _, err := r.parseDestinations(nil); err != errNoDestination {
+		t.Errorf("parseDestinations(nil) = %v, want %v", err, errNoDestination)
+	}
+}
+
+const zeros = "0000000000000000000000000000000000000000000000000000000000000000"
+
+func TestPushSeveralTags(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	reg.requests = nil
+
+	res, err := New(nil, nil).Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1",
+		reg.host+"/out:a", reg.host+"/out:b", reg.host+"/out", reg.host+"/other:c")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+
+	want := []string{
+		reg.host + "/out:a",
+		reg.host + "/out:b",
+		reg.host + "/out@" + res.Digest.String(),
+		reg.host + "/other:c",
+	}
+	if len(res.References) != len(want) {
+		t.Fatalf("References = %v, want %v", res.References, want)
+	}
+	for i, ref := range want {
+		if res.References[i] != ref {
+			t.Errorf("References[%d] = %q, want %q", i, res.References[i], ref)
+		}
+	}
+	if res.Reference != want[0] {
+		t.Errorf("Reference = %q, want %q", res.Reference, want[0])
+	}
+	for _, ref := range []string{"a", "b", res.Digest.String()} {
+		if !reg.has("out", ref) {
+			t.Errorf("out has no manifest %s", ref)
+		}
+	}
+
+	// The blobs of the rebased image are only checked for once per
+	// repository: the config and four layers, in out and in other.
+	if got := reg.count("HEAD", "/v2/out/blobs/"); got != 5 {
+		t.Errorf("%d blob checks in out, want 5", got)
+	}
+	if got := reg.count("HEAD", "/v2/other/blobs/"); got != 5 {
+		t.Errorf("%d blob checks in other, want 5", got)
+	}
+	if got := reg.count("PUT", "/v2/out/manifests/"); got != 2 {
+		t.Errorf("%d manifest puts in out, want 2", got)
+	}
+}
+
+func TestDestinationResolve(t *testing.T) {
+	dsts, err := New(nil, nil).parseDestinations([]string{"gcr.io/foo/bar@sha256:" + zeros})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dsts[0].resolve(v1.Hash{Algorithm: "sha256", Hex: zeros}); err != nil {
+		t.Errorf("resolve() of the same digest = %v", err)
+	}
+	if _, err := dsts[0].resolve(v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("1", 64)}); err == nil {
+		t.Error("resolve() of another digest succeeded, want error")
+	}
+}
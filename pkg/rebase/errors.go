@@ -0,0 +1,290 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// Sentinel errors that the errors returned by this package can be matched
+// against with errors.Is.
+var (
+	// ErrNotBasedOn is matched by a *NotBasedOnError.
+	ErrNotBasedOn = errors.New("image is not based on old base")
+	// ErrMissingLabel is returned when no bases are given and the original
+	// image has no rebase LABEL.
+	ErrMissingLabel = errors.New("could not find LABEL indicating bases")
+	// ErrMalformedLabel is matched by a *MalformedLabelError.
+	ErrMalformedLabel = errors.New("malformed rebase LABEL")
+	// ErrUnauthorized is matched by a *RegistryError whose registry denied
+	// access or whose credentials could not be resolved.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound is matched by a *RegistryError whose manifest, blob or
+	// repository does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrPushRejected is matched by a *RegistryError for a push that the
+	// registry refused.
+	ErrPushRejected = errors.New("push rejected")
+	// ErrPlatformNotFound is matched by a *PlatformNotFoundError.
+	ErrPlatformNotFound = errors.New("platform not found")
+	// ErrPlatformMismatch is matched by a *PlatformMismatchError.
+	ErrPlatformMismatch = errors.New("image and new base are for different platforms")
+	// ErrDrift is matched by a *DriftError.
+	ErrDrift = errors.New("image has changed since the rebase was planned")
+	// ErrUntagged is returned by RebaseArchive for an image in the archive
+	// that has no tag, which cannot be rebased. Under MismatchFail it fails
+	// the rebase; otherwise the image is dropped, with ErrUntagged as its
+	// Mismatch.
+	ErrUntagged = errors.New("image in archive has no tags")
+	// ErrOptionsChanged is matched by an *OptionsChangedError.
+	ErrOptionsChanged = errors.New("options have changed since the rebase was planned")
+)
+
+// NotBasedOnError reports that an original image does not start with the
+// layers of the old base.
+type NotBasedOnError struct {
+	// Original and OldBase are the references the images were resolved
+	// from, if known.
+	Original string
+	OldBase  string
+	// Layer is the index of the first layer of the old base that is not
+	// present in the original. If the original has too few layers, Layer is
+	// the number of layers it has and Got is the zero Hash.
+	Layer int
+	// Want is the diff ID of that layer in the old base, and Got the diff
+	// ID of the layer at the same index in the original.
+	Want v1.Hash
+	Got  v1.Hash
+}
+
+// Error implements error
+func (e *NotBasedOnError) Error() string {
+	reason := fmt.Sprintf("layer %d mismatch", e.Layer)
+	if e.Got == (v1.Hash{}) {
+		reason = "too few layers"
+	}
+	if e.Original == "" || e.OldBase == "" {
+		return fmt.Sprintf("%v (%s)", ErrNotBasedOn, reason)
+	}
+	return fmt.Sprintf("image %q is not based on %q (%s)", e.Original, e.OldBase, reason)
+}
+
+// Is makes errors.Is(err, ErrNotBasedOn) true for a *NotBasedOnError.
+func (e *NotBasedOnError) Is(target error) bool {
+	return target == ErrNotBasedOn
+}
+
+// MalformedLabelError reports a rebase LABEL that does not name two bases.
+type MalformedLabelError struct {
+	Label string
+}
+
+// Error implements error
+func (e *MalformedLabelError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrMalformedLabel, e.Label)
+}
+
+// Is makes errors.Is(err, ErrMalformedLabel) true for a *MalformedLabelError.
+func (e *MalformedLabelError) Is(target error) bool {
+	return target == ErrMalformedLabel
+}
+
+// PlatformNotFoundError reports that an image or index does not provide the
+// platform a rebase needs.
+type PlatformNotFoundError struct {
+	// Ref is the reference of the image or index.
+	Ref      string
+	Platform v1.Platform
+	// Available are the platforms it does provide.
+	Available []v1.Platform
+}
+
+// Error implements error
+func (e *PlatformNotFoundError) Error() string {
+	available := make([]string, len(e.Available))
+	for i, p := range e.Available {
+		available[i] = platformString(p)
+	}
+	return fmt.Sprintf("%q has no image for platform %s (available: %s)", e.Ref, platformString(e.Platform), strings.Join(available, ", "))
+}
+
+// Is makes errors.Is(err, ErrPlatformNotFound) true for a
+// *PlatformNotFoundError.
+func (e *PlatformNotFoundError) Is(target error) bool {
+	return target == ErrPlatformNotFound
+}
+
+// PlatformMismatchError reports that an original image and the new base it
+// would be rebased onto are for different platforms, according to their
+// configs.
+type PlatformMismatchError struct {
+	// Original and NewBase are the references the images were resolved
+	// from, if known.
+	Original string
+	NewBase  string
+	// OriginalPlatform and NewBasePlatform are the platforms the configs
+	// record.
+	OriginalPlatform v1.Platform
+	NewBasePlatform  v1.Platform
+}
+
+// Error implements error
+func (e *PlatformMismatchError) Error() string {
+	if e.Original == "" || e.NewBase == "" {
+		return fmt.Sprintf("%v (%s, %s)", ErrPlatformMismatch, platformString(e.OriginalPlatform), platformString(e.NewBasePlatform))
+	}
+	return fmt.Sprintf("image %q is for platform %s, but new base %q is for %s", e.Original, platformString(e.OriginalPlatform), e.NewBase, platformString(e.NewBasePlatform))
+}
+
+// Is makes errors.Is(err, ErrPlatformMismatch) true for a
+// *PlatformMismatchError.
+func (e *PlatformMismatchError) Is(target error) bool {
+	return target == ErrPlatformMismatch
+}
+
+// DriftError reports that an image no longer has the digest recorded in a
+// PlanFile.
+type DriftError struct {
+	// Image says which image drifted: "original", "old base", "new base" or
+	// "rebased image".
+	Image string
+	// Ref is the reference the image was resolved from.
+	Ref string
+	// Want is the digest recorded in the plan, and Got the digest found
+	// when applying it.
+	Want v1.Hash
+	Got  v1.Hash
+}
+
+// Error implements error
+func (e *DriftError) Error() string {
+	return fmt.Sprintf("%s %q has digest %s, but the plan expects %s", e.Image, e.Ref, e.Got, e.Want)
+}
+
+// Is makes errors.Is(err, ErrDrift) true for a *DriftError.
+func (e *DriftError) Is(target error) bool {
+	return target == ErrDrift
+}
+
+// OptionsChangedError reports that a PlanFile is applied by a Rebaser whose
+// options would produce a different image than the one that was planned.
+type OptionsChangedError struct {
+	// Plan are the options recorded in the plan, and Rebaser those of the
+	// Rebaser applying it.
+	Plan    PlanOptions
+	Rebaser PlanOptions
+}
+
+// Error implements error
+func (e *OptionsChangedError) Error() string {
+	return fmt.Sprintf("plan was made with %s, but is applied with %s", e.Plan, e.Rebaser)
+}
+
+// Is makes errors.Is(err, ErrOptionsChanged) true for an
+// *OptionsChangedError.
+func (e *OptionsChangedError) Is(target error) bool {
+	return target == ErrOptionsChanged
+}
+
+// RegistryError reports a failed interaction with a registry. It wraps the
+// underlying error, which is often a *transport.Error.
+type RegistryError struct {
+	// Op describes what was being attempted, e.g. "get original image".
+	Op string
+	// Ref is the reference or registry that was being accessed.
+	Ref string
+	Err error
+
+	push bool
+}
+
+// Error implements error
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("could not %s %q: %v", e.Op, e.Ref, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// Is classifies the underlying error as ErrUnauthorized, ErrNotFound or
+// ErrPushRejected. A push that the registry refused for want of
+// authorization is classified as ErrUnauthorized only.
+func (e *RegistryError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized, ErrNotFound:
+		return classify(e.Err) == target
+	case ErrPushRejected:
+		if !e.push || classify(e.Err) == ErrUnauthorized {
+			return false
+		}
+		var terr *transport.Error
+		var serr *statusError
+		return errors.As(e.Err, &terr) || errors.As(e.Err, &serr)
+	}
+	return false
+}
+
+// classify maps a registry error onto ErrUnauthorized or ErrNotFound, or nil
+// if it is neither. The codes of a structured registry error take precedence
+// over the status of the response it came in.
+func classify(err error) error {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		for _, d := range terr.Errors {
+			switch d.Code {
+			case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+				return ErrUnauthorized
+			case transport.ManifestUnknownErrorCode, transport.BlobUnknownErrorCode, transport.NameUnknownErrorCode:
+				return ErrNotFound
+			}
+		}
+	}
+	var serr *statusError
+	if errors.As(err, &serr) {
+		switch serr.status {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return ErrUnauthorized
+		case http.StatusNotFound:
+			return ErrNotFound
+		}
+	}
+	return nil
+}
+
+// statusError is an error that came with an HTTP response of status.
+type statusError struct {
+	status int
+	err    error
+}
+
+// Error implements error
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *statusError) Unwrap() error {
+	return e.err
+}
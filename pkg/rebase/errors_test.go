@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestErrorClassification(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		fail     func(r *http.Request) (int, string)
+		orig     string
+		want     []error
+		wantNot  []error
+		wantPush bool
+	}{{
+		desc:    "missing original",
+		orig:    "missing:1",
+		want:    []error{ErrNotFound},
+		wantNot: []error{ErrUnauthorized, ErrPushRejected},
+	}, {
+		desc: "unstructured unauthorized pull",
+		fail: func(r *http.Request) (int, string) {
+			if strings.Contains(r.URL.Path, "/app/manifests/") {
+				return http.StatusUnauthorized, "go away"
+			}
+			return 0, ""
+		},
+		want:    []error{ErrUnauthorized},
+		wantNot: []error{ErrNotFound, ErrPushRejected},
+	}, {
+		desc: "push denied",
+		fail: func(r *http.Request) (int, string) {
+			if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+				return http.StatusForbidden, `{"errors":[{"code":"DENIED","message":"denied"}]}`
+			}
+			return 0, ""
+		},
+		want:     []error{ErrUnauthorized},
+		wantNot:  []error{ErrNotFound, ErrPushRejected},
+		wantPush: true,
+	}, {
+		desc: "invalid manifest",
+		fail: func(r *http.Request) (int, string) {
+			if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+				return http.StatusBadRequest, `{"errors":[{"code":"MANIFEST_INVALID","message":"invalid"}]}`
+			}
+			return 0, ""
+		},
+		want:     []error{ErrPushRejected},
+		wantNot:  []error{ErrNotFound, ErrUnauthorized},
+		wantPush: true,
+	}, {
+		desc: "unstructured upload failure",
+		fail: func(r *http.Request) (int, string) {
+			if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/blobs/uploads/") {
+				return http.StatusInternalServerError, "oops"
+			}
+			return 0, ""
+		},
+		want:     []error{ErrPushRejected},
+		wantNot:  []error{ErrNotFound, ErrUnauthorized},
+		wantPush: true,
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			reg := newTestRegistry(t)
+			reg.pushTestImages(t)
+			reg.fail = test.fail
+			orig := test.orig
+			if orig == "" {
+				orig = "app:1"
+			}
+
+			_, err := New(nil, nil).Rebase(reg.host+"/"+orig, reg.host+"/old:1", reg.host+"/new:1", reg.host+"/app:2")
+			var rerr *RegistryError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("Rebase() = %v, want a *RegistryError", err)
+			}
+			if rerr.push != test.wantPush {
+				t.Errorf("push = %t, want %t (%v)", rerr.push, test.wantPush, err)
+			}
+			for _, target := range test.want {
+				if !errors.Is(err, target) {
+					t.Errorf("errors.Is(%v, %v) = false", err, target)
+				}
+			}
+			for _, target := range test.wantNot {
+				if errors.Is(err, target) {
+					t.Errorf("errors.Is(%v, %v) = true", err, target)
+				}
+			}
+		})
+	}
+}
+
+func TestNotBasedOnError(t *testing.T) {
+	reg := newTestRegistry(t)
+	_, _, newBase := reg.pushTestImages(t)
+	reg.push(t, "other:1", newBase)
+
+	_, err := New(nil, nil).Rebase(reg.host+"/app:1", reg.host+"/other:1", reg.host+"/new:1", reg.host+"/app:2")
+	if !errors.Is(err, ErrNotBasedOn) {
+		t.Fatalf("Rebase() = %v, want ErrNotBasedOn", err)
+	}
+	var nerr *NotBasedOnError
+	if !errors.As(err, &nerr) {
+		t.Fatalf("Rebase() = %v, want a *NotBasedOnError", err)
+	}
+	if nerr.Layer != 0 || nerr.Original != reg.host+"/app:1" || nerr.OldBase != reg.host+"/other:1" {
+		t.Errorf("NotBasedOnError = %+v", nerr)
+	}
+	var rerr *RegistryError
+	if errors.As(err, &rerr) {
+		t.Errorf("Rebase() = %v, want no *RegistryError", err)
+	}
+}
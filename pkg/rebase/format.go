@@ -0,0 +1,188 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Format is the manifest format of a rebased image.
+type Format int
+
+const (
+	// PreserveFormat gives the rebased image the format of the original.
+	PreserveFormat Format = iota
+	// DockerFormat produces a Docker schema 2 manifest.
+	DockerFormat
+	// OCIFormat produces an OCI image manifest.
+	OCIFormat
+)
+
+// String returns the name of the format.
+func (f Format) String() string {
+	switch f {
+	case PreserveFormat:
+		return "preserve"
+	case DockerFormat:
+		return "docker"
+	case OCIFormat:
+		return "oci"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (f Format) MarshalText() ([]byte, error) {
+	switch f {
+	case PreserveFormat, DockerFormat, OCIFormat:
+		return []byte(f.String()), nil
+	}
+	return nil, fmt.Errorf("unknown format %d", int(f))
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (f *Format) UnmarshalText(b []byte) error {
+	for _, g := range []Format{PreserveFormat, DockerFormat, OCIFormat} {
+		if string(b) == g.String() {
+			*f = g
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q", b)
+}
+
+// WithFormat sets the manifest format of rebased images. By default a rebased
+// image has the format of the original.
+func WithFormat(f Format) Option {
+	return func(r *Rebaser) {
+		r.format = f
+	}
+}
+
+// ociMediaTypes and dockerMediaTypes map each media type to its counterpart
+// in the other format. The Docker format has no uncompressed foreign layer,
+// so an OCI uncompressed non-distributable layer has no counterpart.
+var (
+	ociMediaTypes = map[types.MediaType]types.MediaType{
+		types.DockerManifestSchema2:   types.OCIManifestSchema1,
+		types.DockerConfigJSON:        types.OCIConfigJSON,
+		types.DockerLayer:             types.OCILayer,
+		types.DockerUncompressedLayer: types.OCIUncompressedLayer,
+		types.DockerForeignLayer:      types.OCIRestrictedLayer,
+	}
+	dockerMediaTypes = map[types.MediaType]types.MediaType{
+		types.OCIManifestSchema1:   types.DockerManifestSchema2,
+		types.OCIConfigJSON:        types.DockerConfigJSON,
+		types.OCILayer:             types.DockerLayer,
+		types.OCIUncompressedLayer: types.DockerUncompressedLayer,
+		types.OCIRestrictedLayer:   types.DockerForeignLayer,
+	}
+)
+
+// withFormat returns rebased with the media types of its manifest, config
+// and layers set for format f. Layers keep the kind they had in orig or
+// newBase, such as uncompressed or foreign, which mutate.Rebase discards. An
+// uncompressed non-distributable layer cannot be given the Docker format.
+func withFormat(rebased, orig, newBase v1.Image, f Format) (v1.Image, error) {
+	if f == PreserveFormat {
+		mt, err := orig.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		f = DockerFormat
+		if mt == types.OCIManifestSchema1 {
+			f = OCIFormat
+		}
+	}
+	convert := dockerMediaTypes
+	if f == OCIFormat {
+		convert = ociMediaTypes
+	}
+	to := func(mt types.MediaType) types.MediaType {
+		if c, ok := convert[mt]; ok {
+			return c
+		}
+		return mt
+	}
+
+	kinds := map[v1.Hash]types.MediaType{}
+	for _, img := range []v1.Image{newBase, orig} {
+		m, err := img.Manifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range m.Layers {
+			kinds[d.Digest] = d.MediaType
+		}
+	}
+
+	m, err := rebased.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	m.MediaType = to(types.DockerManifestSchema2)
+	m.Config.MediaType = to(types.DockerConfigJSON)
+	for i, d := range m.Layers {
+		mt := d.MediaType
+		if k, ok := kinds[d.Digest]; ok {
+			mt = k
+		}
+		if f == DockerFormat && mt == types.OCIUncompressedRestrictedLayer {
+			return nil, fmt.Errorf("layer %s is uncompressed and non-distributable, which the Docker format cannot describe", d.Digest)
+		}
+		m.Layers[i].MediaType = to(mt)
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &formatImage{Image: rebased, manifest: m, raw: raw}, nil
+}
+
+// formatImage overrides the manifest of an image. Its layers and config are
+// those of the image it wraps.
+type formatImage struct {
+	v1.Image
+	manifest *v1.Manifest
+	raw      []byte
+}
+
+// MediaType implements v1.Image
+func (i *formatImage) MediaType() (types.MediaType, error) {
+	return i.manifest.MediaType, nil
+}
+
+// Manifest implements v1.Image
+func (i *formatImage) Manifest() (*v1.Manifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest implements v1.Image
+func (i *formatImage) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+// Digest implements v1.Image
+func (i *formatImage) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// retyped returns img with the media type of its manifest set to mt, and
+// those of its config and layers set to the types of that format. The first
+// layers are given the types in layers instead.
+func retyped(t *testing.T, img v1.Image, mt types.MediaType, layers ...types.MediaType) v1.Image {
+	t.Helper()
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = m.DeepCopy()
+	m.MediaType = mt
+	config, layer := types.DockerConfigJSON, types.DockerLayer
+	if mt == types.OCIManifestSchema1 {
+		config, layer = types.OCIConfigJSON, types.OCILayer
+	}
+	m.Config.MediaType = config
+	for i := range m.Layers {
+		m.Layers[i].MediaType = layer
+		if i < len(layers) {
+			m.Layers[i].MediaType = layers[i]
+		}
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &formatImage{Image: img, manifest: m, raw: raw}
+}
+
+// checkMediaTypes checks that the manifest of img has media type mt, the
+// config type of that format, and the layer types in layers.
+func checkMediaTypes(t *testing.T, img v1.Image, mt types.MediaType, layers ...types.MediaType) {
+	t.Helper()
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := types.DockerConfigJSON
+	if mt == types.OCIManifestSchema1 {
+		config = types.OCIConfigJSON
+	}
+	if m.MediaType != mt || m.Config.MediaType != config {
+		t.Errorf("manifest has media type %s and config %s, want %s and %s", m.MediaType, m.Config.MediaType, mt, config)
+	}
+	if len(m.Layers) != len(layers) {
+		t.Fatalf("manifest has %d layers, want %d", len(m.Layers), len(layers))
+	}
+	for i, d := range m.Layers {
+		if d.MediaType != layers[i] {
+			t.Errorf("layer %d has media type %s, want %s", i, d.MediaType, layers[i])
+		}
+	}
+}
+
+func TestFormatDockerToOCI(t *testing.T) {
+	orig, oldBase, newBase := testImages(t)
+	rebased, err := New(nil, nil, WithFormat(OCIFormat)).image(orig, oldBase, newBase)
+	if err != nil {
+		t.Fatalf("image() = %v", err)
+	}
+	checkMediaTypes(t, rebased, types.OCIManifestSchema1, types.OCILayer, types.OCILayer, types.OCILayer, types.OCILayer)
+}
+
+func TestFormatOCIToDocker(t *testing.T) {
+	orig, oldBase, newBase := testImages(t)
+	oci := func(img v1.Image) v1.Image {
+		return retyped(t, img, types.OCIManifestSchema1)
+	}
+	orig, oldBase, newBase = oci(orig), oci(oldBase), oci(newBase)
+
+	rebased, err := New(nil, nil).image(orig, oldBase, newBase)
+	if err != nil {
+		t.Fatalf("image() = %v", err)
+	}
+	checkMediaTypes(t, rebased, types.OCIManifestSchema1, types.OCILayer, types.OCILayer, types.OCILayer, types.OCILayer)
+
+	rebased, err = New(nil, nil, WithFormat(DockerFormat)).image(orig, oldBase, newBase)
+	if err != nil {
+		t.Fatalf("image() = %v", err)
+	}
+	checkMediaTypes(t, rebased, types.DockerManifestSchema2, types.DockerLayer, types.DockerLayer, types.DockerLayer, types.DockerLayer)
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	orig, oldBase, newBase := testImages(t)
+	want, err := New(nil, nil).image(orig, oldBase, newBase)
+	if err != nil {
+		t.Fatalf("image() = %v", err)
+	}
+	oci, err := withFormat(want, want, want, OCIFormat)
+	if err != nil {
+		t.Fatalf("withFormat(OCIFormat) = %v", err)
+	}
+	got, err := withFormat(oci, oci, oci, DockerFormat)
+	if err != nil {
+		t.Fatalf("withFormat(DockerFormat) = %v", err)
+	}
+	if mustDigest(t, got) != mustDigest(t, want) {
+		t.Errorf("converting to OCI and back gives %s, want %s", mustDigest(t, got), mustDigest(t, want))
+	}
+}
+
+func TestFormatKeepsLayerKinds(t *testing.T) {
+	orig, oldBase, newBase := testImages(t)
+	newBase = retyped(t, newBase, types.DockerManifestSchema2, types.DockerUncompressedLayer, types.DockerForeignLayer)
+
+	rebased, err := New(nil, nil, WithFormat(OCIFormat)).image(orig, oldBase, newBase)
+	if err != nil {
+		t.Fatalf("image() = %v", err)
+	}
+	checkMediaTypes(t, rebased, types.OCIManifestSchema1, types.OCIUncompressedLayer, types.OCIRestrictedLayer, types.OCILayer, types.OCILayer)
+
+	back, err := withFormat(rebased, rebased, rebased, DockerFormat)
+	if err != nil {
+		t.Fatalf("withFormat(DockerFormat) = %v", err)
+	}
+	checkMediaTypes(t, back, types.DockerManifestSchema2, types.DockerUncompressedLayer, types.DockerForeignLayer, types.DockerLayer, types.DockerLayer)
+}
+
+func TestFormatUncompressedRestricted(t *testing.T) {
+	orig, oldBase, newBase := testImages(t)
+	orig, oldBase = retyped(t, orig, types.OCIManifestSchema1), retyped(t, oldBase, types.OCIManifestSchema1)
+	newBase = retyped(t, newBase, types.OCIManifestSchema1, types.OCIUncompressedRestrictedLayer)
+
+	// The layer keeps its kind in the OCI format, which has it.
+	rebased, err := New(nil, nil).image(orig, oldBase, newBase)
+	if err != nil {
+		t.Fatalf("image() = %v", err)
+	}
+	checkMediaTypes(t, rebased, types.OCIManifestSchema1, types.OCIUncompressedRestrictedLayer, types.OCILayer, types.OCILayer, types.OCILayer)
+
+	// The Docker format cannot describe it.
+	_, err = New(nil, nil, WithFormat(DockerFormat)).image(orig, oldBase, newBase)
+	if err == nil || !strings.Contains(err.Error(), "non-distributable") {
+		t.Errorf("image() with DockerFormat = %v, want an error about the non-distributable layer", err)
+	}
+}
@@ -0,0 +1,295 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+)
+
+// Image returns a new image based on orig, with the layers of oldBase removed
+// and replaced with those in newBase. It returns a *NotBasedOnError if orig
+// does not start with the layers of oldBase, and a *PlatformMismatchError if
+// orig and newBase are for different platforms, unless WithoutPlatformCheck
+// is given.
+//
+// Image only reads the images it is given; fetching inputs and pushing the
+// result are left to the caller. Options that configure registry access are
+// ignored.
+func Image(orig, oldBase, newBase v1.Image, opts ...Option) (v1.Image, error) {
+	return New(nil, nil, opts...).image(orig, oldBase, newBase)
+}
+
+// ImageFromLabel is like Image, but reads the old and new base references
+// from the rebase LABEL of orig and passes each to resolve to obtain the
+// image.
+func ImageFromLabel(orig v1.Image, resolve func(ref string) (v1.Image, error), opts ...Option) (v1.Image, error) {
+	r := New(nil, nil, opts...)
+	cfg, err := orig.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("could not get config for original image: %w", err)
+	}
+	oldBaseStr, newBaseStr, err := r.basesFromLabel(cfg)
+	if err != nil {
+		return nil, err
+	}
+	oldBase, err := resolve(oldBaseStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not get old base image %q: %w", oldBaseStr, err)
+	}
+	newBase, err := resolve(newBaseStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not get new base image %q: %w", newBaseStr, err)
+	}
+	return r.image(orig, oldBase, newBase)
+}
+
+// BasesFromLabel returns the old and new base references named by the rebase
+// LABEL of cfg, in the form "LABEL rebase=<old base> <new base>".
+func BasesFromLabel(cfg *v1.ConfigFile) (oldBase, newBase string, err error) {
+	return getBasesFromLabel(cfg.Config.Labels)
+}
+
+func (r Rebaser) basesFromLabel(cfg *v1.ConfigFile) (string, string, error) {
+	oldBase, newBase, err := BasesFromLabel(cfg)
+	if err != nil {
+		return "", "", err
+	}
+	r.logger.Info("found rebase LABEL", "old_base", oldBase, "new_base", newBase)
+	return oldBase, newBase, nil
+}
+
+// image checks that oldBase is a prefix of orig and stitches the rebased
+// image together, in the format the Rebaser is configured for.
+func (r Rebaser) image(orig, oldBase, newBase v1.Image) (v1.Image, error) {
+	if err := checkBase(orig, oldBase); err != nil {
+		var nerr *NotBasedOnError
+		if errors.As(err, &nerr) {
+			r.logger.Warn("original is not based on old base", "layer", nerr.Layer, "want", nerr.Want.String(), "got", nerr.Got.String())
+		}
+		return nil, err
+	}
+	if !r.anyPlatform {
+		if err := checkPlatformMatch(orig, newBase); err != nil {
+			if perr, ok := err.(*PlatformMismatchError); ok {
+				r.logger.Warn("original and new base are for different platforms", "original", platformString(perr.OriginalPlatform), "new_base", platformString(perr.NewBasePlatform))
+			}
+			return nil, err
+		}
+	}
+	rebased, err := stitch(orig, oldBase, newBase)
+	if err != nil {
+		return nil, fmt.Errorf("error rebasing image: %w", err)
+	}
+	rebased, err = withFormat(rebased, orig, newBase, r.format)
+	if err != nil {
+		return nil, fmt.Errorf("error setting media types of rebased image: %w", err)
+	}
+	return rebased, nil
+}
+
+// checkBase returns a *NotBasedOnError unless the layers of oldBase are a
+// prefix of the layers of orig. Layers are compared by diff ID, since the
+// layers of an image read from a "docker save" archive or a Docker Engine
+// are compressed afresh and so have other digests than in a registry.
+func checkBase(orig, oldBase v1.Image) error {
+	origLayers, err := orig.Layers()
+	if err != nil {
+		return fmt.Errorf("failed to get layers for original: %w", err)
+	}
+	oldBaseLayers, err := oldBase.Layers()
+	if err != nil {
+		return fmt.Errorf("failed to get layers for old base: %w", err)
+	}
+	for i, l := range oldBaseLayers {
+		want, err := l.DiffID()
+		if err != nil {
+			return fmt.Errorf("failed to get diff ID of layer %d of old base: %w", i, err)
+		}
+		if i >= len(origLayers) {
+			return &NotBasedOnError{Layer: i, Want: want}
+		}
+		got, err := origLayers[i].DiffID()
+		if err != nil {
+			return fmt.Errorf("failed to get diff ID of layer %d of original: %w", i, err)
+		}
+		if got != want {
+			return &NotBasedOnError{Layer: i, Want: want, Got: got}
+		}
+	}
+	return nil
+}
+
+// stitch returns an image with the config of orig, the layers of newBase,
+// and the layers of orig above those of oldBase, along with their history.
+// This is mutate.Rebase without its own comparison of oldBase and orig,
+// which checkBase has already made by diff ID.
+func stitch(orig, oldBase, newBase v1.Image) (v1.Image, error) {
+	origConfig, err := orig.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config for original: %w", err)
+	}
+	newConfig, err := newBase.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config for new base: %w", err)
+	}
+	origLayers, err := orig.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get layers for original: %w", err)
+	}
+	oldBaseLayers, err := oldBase.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get layers for old base: %w", err)
+	}
+	newBaseLayers, err := newBase.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get layers for new base: %w", err)
+	}
+
+	// Like mutate.Rebase, pair the nth layer with the nth history entry.
+	history := func(cfg *v1.ConfigFile, i int) v1.History {
+		if i < len(cfg.History) {
+			return cfg.History[i]
+		}
+		return v1.History{}
+	}
+	var adds []mutate.Addendum
+	for i, l := range newBaseLayers {
+		adds = append(adds, mutate.Addendum{Layer: l, History: history(newConfig, i)})
+	}
+	for i := len(oldBaseLayers); i < len(origLayers); i++ {
+		adds = append(adds, mutate.Addendum{Layer: origLayers[i], History: history(origConfig, i)})
+	}
+	rebased, err := mutate.Config(empty.Image, *origConfig.Config.DeepCopy())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create empty image with original config: %w", err)
+	}
+	if rebased, err = mutate.Append(rebased, adds...); err != nil {
+		return nil, err
+	}
+	return withConfigFields(rebased, orig)
+}
+
+// configFields are the top-level fields of a config that stitch copies from
+// the original, since mutate.Config only carries over its "config" object.
+var configFields = []string{"architecture", "os", "variant", "os.version", "os.features", "created", "author"}
+
+// withConfigFields returns img with the configFields of orig's config. They
+// are copied from the raw config, because the vendored v1.ConfigFile has no
+// variant and reads os.version from the wrong key.
+func withConfigFields(img, orig v1.Image) (v1.Image, error) {
+	origRaw, err := orig.RawConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config for original: %w", err)
+	}
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	var from, to map[string]json.RawMessage
+	if err := json.Unmarshal(origRaw, &from); err != nil {
+		return nil, fmt.Errorf("failed to parse config of original: %w", err)
+	}
+	if err := json.Unmarshal(raw, &to); err != nil {
+		return nil, err
+	}
+	for _, k := range configFields {
+		if v, ok := from[k]; ok {
+			to[k] = v
+		} else {
+			delete(to, k)
+		}
+	}
+	if raw, err = json.Marshal(to); err != nil {
+		return nil, err
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	h, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	m.Config.Digest, m.Config.Size = h, size
+	rawManifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &configImage{Image: img, manifest: m, rawManifest: rawManifest, config: raw}, nil
+}
+
+// configImage overrides the config of an image, and its manifest to match.
+// Its layers are those of the image it wraps.
+type configImage struct {
+	v1.Image
+	manifest    *v1.Manifest
+	rawManifest []byte
+	config      []byte
+}
+
+// RawConfigFile implements v1.Image
+func (i *configImage) RawConfigFile() ([]byte, error) {
+	return i.config, nil
+}
+
+// ConfigFile implements v1.Image
+func (i *configImage) ConfigFile() (*v1.ConfigFile, error) {
+	return v1.ParseConfigFile(bytes.NewReader(i.config))
+}
+
+// ConfigName implements v1.Image
+func (i *configImage) ConfigName() (v1.Hash, error) {
+	return i.manifest.Config.Digest, nil
+}
+
+// Manifest implements v1.Image
+func (i *configImage) Manifest() (*v1.Manifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest implements v1.Image
+func (i *configImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+// Digest implements v1.Image
+func (i *configImage) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+func getBasesFromLabel(lbls map[string]string) (string, string, error) {
+	lbl, found := lbls["rebase"]
+	if !found {
+		return "", "", ErrMissingLabel
+	}
+	parts := strings.Split(lbl, " ")
+	if len(parts) < 2 {
+		return "", "", &MalformedLabelError{Label: lbl}
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// recompressed returns an image with the layers of img, compressed at
+// another level, so that their digests differ but their diff IDs do not.
+func recompressed(t *testing.T, img v1.Image) v1.Image {
+	t.Helper()
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []v1.Layer
+	for _, l := range ls {
+		rc, err := l.Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&b, gzip.BestCompression)
+		_, err = io.Copy(zw, rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		gz := b.Bytes()
+		rl, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(gz)), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, rl)
+	}
+	r, err := mutate.AppendLayers(empty.Image, out...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func layerDigest(t *testing.T, img v1.Image, i int) v1.Hash {
+	t.Helper()
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mustLayerDigest(t, ls[i])
+}
+
+func TestCheckBaseRecompressed(t *testing.T) {
+	orig, oldBase, newBase := testImages(t)
+	recomp := recompressed(t, oldBase)
+	ls, err := recomp.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mustLayerDigest(t, ls[0]) == layerDigest(t, oldBase, 0) {
+		t.Fatal("recompressed layer has the same digest")
+	}
+
+	if err := checkBase(orig, recomp); err != nil {
+		t.Errorf("checkBase() = %v", err)
+	}
+	rebased, err := Image(orig, recomp, newBase)
+	if err != nil {
+		t.Fatalf("Image() = %v", err)
+	}
+	rls, err := rebased.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rls) != 4 {
+		t.Errorf("rebased image has %d layers, want 4", len(rls))
+	}
+}
+
+func TestCheckBaseDifferentBase(t *testing.T) {
+	orig, oldBase, _ := testImages(t)
+	_, other, _ := testImages(t)
+
+	var nerr *NotBasedOnError
+	if err := checkBase(orig, other); !errors.As(err, &nerr) {
+		t.Fatalf("checkBase() = %v, want a *NotBasedOnError", err)
+	}
+	if nerr.Layer != 0 || nerr.Want != diffIDs(t, other)[0] || nerr.Got != diffIDs(t, orig)[0] {
+		t.Errorf("NotBasedOnError = %+v, want layer 0 with the diff IDs of both", nerr)
+	}
+
+	// The original of a base has too few layers to be based on it.
+	if err := checkBase(oldBase, orig); !errors.As(err, &nerr) || nerr.Layer != 2 || nerr.Got != (v1.Hash{}) {
+		t.Errorf("checkBase() = %v, want too few layers at layer 2", err)
+	}
+}
@@ -0,0 +1,569 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// MissingPlatformPolicy says what RebaseIndex does with an image of the
+// original index whose platform the new base index does not have.
+type MissingPlatformPolicy int
+
+const (
+	// MissingPlatformFail fails the whole rebase.
+	MissingPlatformFail MissingPlatformPolicy = iota
+	// MissingPlatformDrop leaves the image out of the new index.
+	MissingPlatformDrop
+	// MissingPlatformCarry copies the image to the new index unchanged.
+	MissingPlatformCarry
+)
+
+// String returns the name of the policy.
+func (p MissingPlatformPolicy) String() string {
+	switch p {
+	case MissingPlatformFail:
+		return "fail"
+	case MissingPlatformDrop:
+		return "drop"
+	case MissingPlatformCarry:
+		return "carry"
+	}
+	return fmt.Sprintf("MissingPlatformPolicy(%d)", int(p))
+}
+
+// WithMissingPlatformPolicy sets what RebaseIndex does with images whose
+// platform the new base index does not have. The default is
+// MissingPlatformFail.
+func WithMissingPlatformPolicy(p MissingPlatformPolicy) Option {
+	return func(r *Rebaser) {
+		r.missing = p
+	}
+}
+
+// IndexResult describes a rebased image index.
+type IndexResult struct {
+	// Reference is the first reference the rebased index was pushed to,
+	// and References lists all of them.
+	Reference  string
+	References []string
+	// Digest is the digest of the rebased index.
+	Digest v1.Hash
+
+	// Original, OldBase and NewBase are the digests of the input indexes.
+	// They are zero for an index assembled by RebaseMulti.
+	Original v1.Hash
+	OldBase  v1.Hash
+	NewBase  v1.Hash
+
+	// Platforms describes the entries of the original index, in its order.
+	// The entries of the rebased index keep that order too.
+	Platforms []PlatformResult
+}
+
+// PlatformResult describes the rebase of one entry of an image index.
+type PlatformResult struct {
+	Platform v1.Platform
+	// Result describes the rebased image, or is nil if the image was not
+	// rebased. Its Reference and References are empty, since the image is
+	// pushed as part of the index.
+	Result *Result
+	// Missing is why the image was not rebased, a *PlatformNotFoundError
+	// for the new base index.
+	Missing error
+	// Dropped reports whether the image was left out of the new index. An
+	// image that was not rebased and not dropped was carried into the new
+	// index unchanged.
+	Dropped bool
+	// Attestation is the digest of the image that the entry attests to, if
+	// it is an attestation manifest rather than an image.
+	Attestation v1.Hash
+}
+
+// RebaseIndex rebases every image in the image index or manifest list orig
+// onto the image for the same platform in newBase, after checking that it
+// is based on the one in oldBase, and pushes a new index of the results to
+// each reference in rebased. Images are paired by os, architecture and
+// variant, and by os.version if the entry in orig gives one. All of the
+// references must be in registries.
+//
+// An image whose platform newBase does not have is handled according to the
+// Rebaser's MissingPlatformPolicy.
+//
+// Attestation manifests in orig, such as those buildx adds, are dropped,
+// since they attest to images that the rebase replaces. Those of an image
+// carried unchanged are kept. If WithFormat selects a format, a carried image
+// is converted to it, and so loses its attestations, and an attestation in
+// the other format is dropped.
+//
+// If oldBaseStr and newBaseStr are empty, the bases are read from the rebase
+// LABEL of the first image in orig that is not an attestation.
+func (r Rebaser) RebaseIndex(ctx context.Context, origStr, oldBaseStr, newBaseStr string, rebasedStrs ...string) (*IndexResult, error) {
+	dsts, err := r.indexDestinations(rebasedStrs)
+	if err != nil {
+		return nil, err
+	}
+
+	t := r.roundTripper(ctx)
+	defer t.close()
+	in, err := r.resolveIndexes(ctx, t, origStr, oldBaseStr, newBaseStr)
+	if err != nil {
+		return nil, err
+	}
+	idx, res, err := r.buildIndex(ctx, t, in)
+	if err != nil {
+		return nil, err
+	}
+	return r.publishIndex(ctx, t, idx, res, dsts)
+}
+
+// indexDestinations parses the references a rebased index is pushed to,
+// which must all be in registries.
+func (r Rebaser) indexDestinations(strs []string) ([]destination, error) {
+	dsts, err := r.parseDestinations(strs)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dsts {
+		if !d.registry() {
+			return nil, fmt.Errorf("could not push index to %q: an index can only be pushed to a registry", d.str)
+		}
+	}
+	return dsts, nil
+}
+
+// publishIndex pushes idx, described by res, to dsts in the Push phase and
+// records where it went in res.
+func (r Rebaser) publishIndex(ctx context.Context, t *contextTransport, idx v1.ImageIndex, res *IndexResult, dsts []destination) (*IndexResult, error) {
+	pushCtx, cancel := t.phase(ctx, r.timeouts.Push)
+	defer cancel()
+	for _, d := range dsts {
+		ref, err := d.resolve(res.Digest)
+		if err != nil {
+			return nil, &RegistryError{Op: "put new index", Ref: d.str, Err: err, push: true}
+		}
+		a, err := r.keychain.Resolve(d.repo.Registry)
+		if err != nil {
+			return nil, &RegistryError{Op: "authorize to", Ref: d.repo.RegistryStr(), Err: fmt.Errorf("%w: %v", ErrUnauthorized, err)}
+		}
+		p := r.newProgress(ref.String())
+		if err := remote.WriteIndex(ref, p.index(idx), a, p.transport(t, res.Digest)); err != nil {
+			if ctxErr := pushCtx.Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			r.logger.Warn("push failed", "ref", ref.String(), "error", err)
+			return nil, &RegistryError{Op: "put new index", Ref: d.str, Err: t.withStatus(err), push: true}
+		}
+		r.logger.Info("pushed index", "ref", ref.String(), "digest", res.Digest.String())
+		res.References = append(res.References, ref.String())
+	}
+	res.Reference = res.References[0]
+	return res, nil
+}
+
+// indexInputs are the indexes an index rebase operates on, and the
+// references they were resolved from.
+type indexInputs struct {
+	orig, oldBase, newBase          v1.ImageIndex
+	origStr, oldBaseStr, newBaseStr string
+}
+
+// resolveIndexes fetches the original index and both base indexes in the
+// Resolve phase.
+func (r Rebaser) resolveIndexes(ctx context.Context, t *contextTransport, origStr, oldBaseStr, newBaseStr string) (*indexInputs, error) {
+	ctx, cancel := t.phase(ctx, r.timeouts.Resolve)
+	defer cancel()
+
+	orig, err := r.getIndex(t, origStr)
+	if err != nil {
+		return nil, &RegistryError{Op: "get original index", Ref: origStr, Err: t.withStatus(err)}
+	}
+	if oldBaseStr == "" && newBaseStr == "" {
+		m, err := orig.IndexManifest()
+		if err != nil {
+			return nil, &RegistryError{Op: "get original index", Ref: origStr, Err: t.withStatus(err)}
+		}
+		var first *v1.Descriptor
+		for i, desc := range m.Manifests {
+			if !isAttestation(desc) {
+				first = &m.Manifests[i]
+				break
+			}
+		}
+		if first == nil {
+			return nil, fmt.Errorf("index %q holds no image", origStr)
+		}
+		img, err := orig.Image(first.Digest)
+		if err != nil {
+			return nil, &RegistryError{Op: "get original image", Ref: origStr, Err: t.withStatus(err)}
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, &RegistryError{Op: "get config for original image", Ref: origStr, Err: t.withStatus(err)}
+		}
+		if oldBaseStr, newBaseStr, err = r.basesFromLabel(cfg); err != nil {
+			return nil, err
+		}
+	}
+	oldBase, err := r.getIndex(t, oldBaseStr)
+	if err != nil {
+		return nil, &RegistryError{Op: "get old base index", Ref: oldBaseStr, Err: t.withStatus(err)}
+	}
+	newBase, err := r.getIndex(t, newBaseStr)
+	if err != nil {
+		return nil, &RegistryError{Op: "get new base index", Ref: newBaseStr, Err: t.withStatus(err)}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &indexInputs{
+		orig:       orig,
+		oldBase:    oldBase,
+		newBase:    newBase,
+		origStr:    origStr,
+		oldBaseStr: oldBaseStr,
+		newBaseStr: newBaseStr,
+	}, nil
+}
+
+// getIndex resolves the registry reference s to an image index.
+func (r Rebaser) getIndex(t *contextTransport, s string) (v1.ImageIndex, error) {
+	ref, ok := r.registryRef(s)
+	if !ok {
+		return nil, errors.New("an index can only be read from a registry")
+	}
+	client, err := r.pullClient(t, ref)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := r.fetchIndex(client, ref)
+	if err != nil {
+		return nil, err
+	}
+	h, err := idx.Digest()
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Debug("resolved index", "ref", s, "digest", h.String())
+	return idx, nil
+}
+
+// buildIndex rebases each image of the original index onto the new base
+// image for its platform, and assembles the results into a new index.
+func (r Rebaser) buildIndex(ctx context.Context, t *contextTransport, in *indexInputs) (v1.ImageIndex, *IndexResult, error) {
+	var res IndexResult
+	var err error
+	if res.Original, err = in.orig.Digest(); err != nil {
+		return nil, nil, err
+	}
+	if res.OldBase, err = in.oldBase.Digest(); err != nil {
+		return nil, nil, err
+	}
+	if res.NewBase, err = in.newBase.Digest(); err != nil {
+		return nil, nil, err
+	}
+	origManifest, err := in.orig.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	oldBaseManifest, err := in.oldBase.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	newBaseManifest, err := in.newBase.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Each entry is decided first, and then added in its place. Attestations
+	// are decided last, since they are kept only if the image they attest
+	// to is carried unchanged.
+	children := make([]v1.Image, len(origManifest.Manifests))
+	results := make([]*PlatformResult, len(origManifest.Manifests))
+	unchanged := map[v1.Hash]bool{}
+	for i, desc := range origManifest.Manifests {
+		if isAttestation(desc) {
+			continue
+		}
+		p := descPlatform(desc)
+		switch desc.MediaType {
+		case types.OCIImageIndex, types.DockerManifestList:
+			return nil, nil, fmt.Errorf("index %q holds a nested index, which cannot be rebased", in.origStr)
+		}
+		newBaseDesc, err := findPlatform(in.newBaseStr, newBaseManifest, p)
+		if err != nil {
+			if r.missing == MissingPlatformFail {
+				return nil, nil, err
+			}
+			if children[i], results[i], err = r.missingChild(in, &desc, err, unchanged); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		oldBaseDesc, err := findPlatform(in.oldBaseStr, oldBaseManifest, p)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if children[i], results[i], err = r.rebaseChild(ctx, t, in, &desc, oldBaseDesc, newBaseDesc); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i, desc := range origManifest.Manifests {
+		if isAttestation(desc) {
+			if children[i], results[i], err = r.attestation(in, &desc, unchanged); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	b := newIndexBuilder(origManifest)
+	for i := range origManifest.Manifests {
+		if children[i] != nil {
+			if err := b.add(&origManifest.Manifests[i], children[i]); err != nil {
+				return nil, nil, err
+			}
+		}
+		res.Platforms = append(res.Platforms, *results[i])
+	}
+
+	idx, err := b.build(r.format)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.Digest, err = idx.Digest(); err != nil {
+		return nil, nil, err
+	}
+	return idx, &res, nil
+}
+
+// missingChild drops the image desc describes in the original index, or
+// returns it to be carried unchanged, because the new base index lacks its
+// platform. A carried image is converted to the Rebaser's format, if it sets
+// one, and is recorded in unchanged unless that changes it.
+func (r Rebaser) missingChild(in *indexInputs, desc *v1.Descriptor, missing error, unchanged map[v1.Hash]bool) (v1.Image, *PlatformResult, error) {
+	pr := &PlatformResult{
+		Platform: descPlatform(*desc),
+		Missing:  missing,
+		Dropped:  r.missing == MissingPlatformDrop,
+	}
+	if pr.Dropped {
+		r.logger.Warn("dropped platform", "platform", platformString(pr.Platform), "error", missing)
+		return nil, pr, nil
+	}
+	img, err := in.orig.Image(desc.Digest)
+	if err != nil {
+		return nil, nil, &RegistryError{Op: "get original image", Ref: in.origStr, Err: err}
+	}
+	if r.format != PreserveFormat {
+		if img, err = withFormat(img, img, img, r.format); err != nil {
+			return nil, nil, fmt.Errorf("error setting media types of carried image: %w", err)
+		}
+	}
+	h, err := img.Digest()
+	if err != nil {
+		return nil, nil, err
+	}
+	if h == desc.Digest {
+		unchanged[h] = true
+	}
+	r.logger.Warn("carried platform unchanged", "platform", platformString(pr.Platform), "error", missing)
+	return img, pr, nil
+}
+
+// attestation returns the attestation manifest desc describes in the
+// original index if the image it attests to is in unchanged and it is in the
+// Rebaser's format, and drops it otherwise.
+func (r Rebaser) attestation(in *indexInputs, desc *v1.Descriptor, unchanged map[v1.Hash]bool) (v1.Image, *PlatformResult, error) {
+	pr := &PlatformResult{Platform: descPlatform(*desc), Dropped: true}
+	subject, err := v1.NewHash(desc.Annotations[referenceDigestAnnotation])
+	if err != nil {
+		r.logger.Warn("dropped attestation", "digest", desc.Digest.String(), "error", err)
+		return nil, pr, nil
+	}
+	pr.Attestation = subject
+	if !unchanged[subject] {
+		r.logger.Info("dropped attestation", "digest", desc.Digest.String(), "subject", subject.String())
+		return nil, pr, nil
+	}
+	if (r.format == DockerFormat && desc.MediaType == types.OCIManifestSchema1) || (r.format == OCIFormat && desc.MediaType == types.DockerManifestSchema2) {
+		r.logger.Info("dropped attestation in other format", "digest", desc.Digest.String(), "format", r.format.String())
+		return nil, pr, nil
+	}
+	img, err := in.orig.Image(desc.Digest)
+	if err != nil {
+		return nil, nil, &RegistryError{Op: "get attestation", Ref: in.origStr, Err: err}
+	}
+	pr.Dropped = false
+	return img, pr, nil
+}
+
+// rebaseChild rebases the image desc describes in the original index onto
+// the one newBaseDesc describes in the new base index.
+func (r Rebaser) rebaseChild(ctx context.Context, t *contextTransport, in *indexInputs, desc, oldBaseDesc, newBaseDesc *v1.Descriptor) (v1.Image, *PlatformResult, error) {
+	// Name each image by digest in the repository of its index.
+	child := func(idx v1.ImageIndex, s string, h v1.Hash) (v1.Image, string, error) {
+		ref, err := name.ParseReference(s, r.strictness)
+		if err != nil {
+			return nil, "", err
+		}
+		img, err := idx.Image(h)
+		return img, fmt.Sprintf("%s@%s", ref.Context(), h), err
+	}
+	orig, origStr, err := child(in.orig, in.origStr, desc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	oldBase, oldBaseStr, err := child(in.oldBase, in.oldBaseStr, oldBaseDesc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	newBase, newBaseStr, err := child(in.newBase, in.newBaseStr, newBaseDesc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rebased, res, err := r.build(ctx, t, &inputs{
+		orig:       orig,
+		oldBase:    oldBase,
+		newBase:    newBase,
+		origStr:    origStr,
+		oldBaseStr: oldBaseStr,
+		newBaseStr: newBaseStr,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	p := descPlatform(*desc)
+	r.logger.Info("rebased platform", "platform", platformString(p), "digest", res.Digest.String())
+	return rebased, &PlatformResult{Platform: p, Result: res}, nil
+}
+
+// indexBuilder assembles an image index from the entries of an original
+// index and the images that replace them.
+type indexBuilder struct {
+	orig    *v1.IndexManifest
+	entries []v1.Descriptor
+	images  map[v1.Hash]v1.Image
+}
+
+func newIndexBuilder(orig *v1.IndexManifest) *indexBuilder {
+	return &indexBuilder{orig: orig, images: map[v1.Hash]v1.Image{}}
+}
+
+// add appends an entry for img, keeping the platform and annotations of
+// desc.
+func (b *indexBuilder) add(desc *v1.Descriptor, img v1.Image) error {
+	d := *desc
+	var err error
+	if d.MediaType, err = img.MediaType(); err != nil {
+		return err
+	}
+	if d.Digest, err = img.Digest(); err != nil {
+		return err
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	d.Size = int64(len(raw))
+	b.entries = append(b.entries, d)
+	b.images[d.Digest] = img
+	return nil
+}
+
+// build returns the assembled index. Its media type follows the original
+// index unless f selects a format.
+func (b *indexBuilder) build(f Format) (v1.ImageIndex, error) {
+	if len(b.entries) == 0 {
+		return nil, errors.New("no image is left in the index")
+	}
+	m := *b.orig
+	m.Manifests = b.entries
+	switch f {
+	case DockerFormat:
+		m.MediaType = types.DockerManifestList
+	case OCIFormat:
+		m.MediaType = types.OCIImageIndex
+	}
+	if m.MediaType == "" {
+		// OCI indexes need not give their media type.
+		m.MediaType = types.OCIImageIndex
+		for _, d := range m.Manifests {
+			if d.MediaType == types.DockerManifestSchema2 {
+				m.MediaType = types.DockerManifestList
+			}
+		}
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &index{manifest: &m, raw: raw, images: b.images}, nil
+}
+
+// index is an image index assembled in memory.
+type index struct {
+	manifest *v1.IndexManifest
+	raw      []byte
+	images   map[v1.Hash]v1.Image
+}
+
+var _ v1.ImageIndex = (*index)(nil)
+
+// MediaType implements v1.ImageIndex
+func (i *index) MediaType() (types.MediaType, error) {
+	return i.manifest.MediaType, nil
+}
+
+// Digest implements v1.ImageIndex
+func (i *index) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+// IndexManifest implements v1.ImageIndex
+func (i *index) IndexManifest() (*v1.IndexManifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest implements v1.ImageIndex
+func (i *index) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+// Image implements v1.ImageIndex
+func (i *index) Image(h v1.Hash) (v1.Image, error) {
+	img, ok := i.images[h]
+	if !ok {
+		return nil, fmt.Errorf("image %s not found in index", h)
+	}
+	return img, nil
+}
+
+// ImageIndex implements v1.ImageIndex
+func (i *index) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	return nil, fmt.Errorf("index %s not found in index", h)
+}
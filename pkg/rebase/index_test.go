@@ -0,0 +1,442 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// indexEntry is an image of a test index and the platform it is listed for.
+type indexEntry struct {
+	platform    v1.Platform
+	annotations map[string]string
+	img         v1.Image
+}
+
+// pushIndex pushes the images of entries to repo, and an index of them
+// tagged tag.
+func (reg *testRegistry) pushIndex(t *testing.T, repo, tag string, entries ...indexEntry) {
+	t.Helper()
+	m := v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	for i, e := range entries {
+		reg.push(t, fmt.Sprintf("%s:%s-%d", repo, tag, i), e.img)
+		raw, err := e.img.RawManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mt, err := e.img.MediaType()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := e.platform
+		m.Manifests = append(m.Manifests, v1.Descriptor{
+			MediaType:   mt,
+			Size:        int64(len(raw)),
+			Digest:      mustDigest(t, e.img),
+			Platform:    &p,
+			Annotations: e.annotations,
+		})
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.mu.Lock()
+	reg.putManifest(repo, tag, raw, string(types.OCIImageIndex))
+	reg.mu.Unlock()
+}
+
+// pushedIndex returns the index tagged tag in repo.
+func (reg *testRegistry) pushedIndex(t *testing.T, repo, tag string) *v1.IndexManifest {
+	t.Helper()
+	reg.mu.Lock()
+	raw, ok := reg.manifests[repo][tag]
+	reg.mu.Unlock()
+	if !ok {
+		t.Fatalf("%s:%s was not pushed", repo, tag)
+	}
+	m, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// attestationFor returns an attestation manifest entry for img.
+func attestationFor(t *testing.T, img v1.Image) indexEntry {
+	t.Helper()
+	att, err := random.Image(16, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return indexEntry{
+		platform: v1.Platform{OS: "unknown", Architecture: "unknown"},
+		annotations: map[string]string{
+			referenceTypeAnnotation:   "attestation-manifest",
+			referenceDigestAnnotation: mustDigest(t, img).String(),
+		},
+		img: att,
+	}
+}
+
+var (
+	amd64 = v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 = v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+)
+
+// checkRebasedOnto fails unless rebased has the layers of newBase followed by
+// the top layer of orig.
+func checkRebasedOnto(t *testing.T, rebased *Result, orig, newBase v1.Image) {
+	t.Helper()
+	if rebased == nil {
+		t.Fatal("image was not rebased")
+	}
+	if rebased.NewBase != mustDigest(t, newBase) || rebased.Original != mustDigest(t, orig) {
+		t.Errorf("rebased %s onto %s, want %s onto %s", rebased.Original, rebased.NewBase, mustDigest(t, orig), mustDigest(t, newBase))
+	}
+}
+
+// checkChildPlatforms fails unless the config of every image in m, pushed to
+// repo, records the platform its entry gives.
+func (reg *testRegistry) checkChildPlatforms(t *testing.T, repo string, m *v1.IndexManifest) {
+	t.Helper()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, d := range m.Manifests {
+		if isAttestation(d) {
+			continue
+		}
+		cm, err := v1.ParseManifest(bytes.NewReader(reg.manifests[repo][d.Digest.String()]))
+		if err != nil {
+			t.Fatalf("could not read pushed image %s: %v", d.Digest, err)
+		}
+		var cfg struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant"`
+			OSVersion    string `json:"os.version"`
+		}
+		if err := json.Unmarshal(reg.blobs[cm.Config.Digest.String()], &cfg); err != nil {
+			t.Fatalf("could not read config of pushed image %s: %v", d.Digest, err)
+		}
+		got := platformString(v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant, OSVersion: cfg.OSVersion})
+		if d.Platform == nil || got != platformString(*d.Platform) {
+			t.Errorf("config of pushed image %s records %s, but its entry gives %+v", d.Digest, got, d.Platform)
+		}
+	}
+}
+
+// platformImages returns the images from testImages, with their configs
+// recording p.
+func platformImages(t *testing.T, p v1.Platform) (orig, oldBase, newBase v1.Image) {
+	t.Helper()
+	orig, oldBase, newBase = testImages(t)
+	return withConfigPlatform(t, orig, p), withConfigPlatform(t, oldBase, p), withConfigPlatform(t, newBase, p)
+}
+
+func TestRebaseIndex(t *testing.T) {
+	reg := newTestRegistry(t)
+	origA, oldA, newA := platformImages(t, amd64)
+	origB, oldB, newB := platformImages(t, arm64)
+	reg.pushIndex(t, "app", "1", indexEntry{platform: amd64, img: origA}, indexEntry{platform: arm64, img: origB}, attestationFor(t, origA))
+	reg.pushIndex(t, "old", "1", indexEntry{platform: arm64, img: oldB}, indexEntry{platform: amd64, img: oldA})
+	reg.pushIndex(t, "new", "1", indexEntry{platform: amd64, img: newA}, indexEntry{platform: arm64, img: newB})
+
+	res, err := New(nil, nil).RebaseIndex(context.Background(), reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("RebaseIndex() = %v", err)
+	}
+	if len(res.Platforms) != 3 {
+		t.Fatalf("Platforms = %+v, want 3 entries", res.Platforms)
+	}
+	checkRebasedOnto(t, res.Platforms[0].Result, origA, newA)
+	checkRebasedOnto(t, res.Platforms[1].Result, origB, newB)
+	if att := res.Platforms[2]; !att.Dropped || att.Attestation != mustDigest(t, origA) || att.Result != nil {
+		t.Errorf("attestation = %+v, want it dropped", att)
+	}
+
+	m := reg.pushedIndex(t, "out", "1")
+	if len(m.Manifests) != 2 {
+		t.Fatalf("pushed index has %d entries, want 2", len(m.Manifests))
+	}
+	for i, want := range []*Result{res.Platforms[0].Result, res.Platforms[1].Result} {
+		if m.Manifests[i].Digest != want.Digest {
+			t.Errorf("pushed entry %d = %s, want %s", i, m.Manifests[i].Digest, want.Digest)
+		}
+	}
+	reg.checkChildPlatforms(t, "out", m)
+}
+
+func TestRebaseIndexOSVersion(t *testing.T) {
+	reg := newTestRegistry(t)
+	ltsc2019 := v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"}
+	ltsc2022 := v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.1"}
+	orig, oldBase, newBase := platformImages(t, ltsc2019)
+	_, otherOld, otherNew := platformImages(t, ltsc2022)
+	reg.pushIndex(t, "app", "1", indexEntry{platform: ltsc2019, img: orig})
+	reg.pushIndex(t, "old", "1", indexEntry{platform: ltsc2022, img: otherOld}, indexEntry{platform: ltsc2019, img: oldBase})
+	reg.pushIndex(t, "new", "1", indexEntry{platform: ltsc2022, img: otherNew}, indexEntry{platform: ltsc2019, img: newBase})
+
+	res, err := New(nil, nil).RebaseIndex(context.Background(), reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("RebaseIndex() = %v", err)
+	}
+	checkRebasedOnto(t, res.Platforms[0].Result, orig, newBase)
+	m := reg.pushedIndex(t, "out", "1")
+	if got := m.Manifests[0].Platform; got == nil || got.OSVersion != ltsc2019.OSVersion {
+		t.Errorf("pushed platform = %+v, want %+v", got, ltsc2019)
+	}
+	reg.checkChildPlatforms(t, "out", m)
+}
+
+func TestRebaseIndexMissingPlatform(t *testing.T) {
+	reg := newTestRegistry(t)
+	origA, oldA, newA := platformImages(t, amd64)
+	origB, oldB, _ := platformImages(t, arm64)
+	reg.pushIndex(t, "app", "1", indexEntry{platform: amd64, img: origA}, indexEntry{platform: arm64, img: origB}, attestationFor(t, origA), attestationFor(t, origB))
+	reg.pushIndex(t, "old", "1", indexEntry{platform: amd64, img: oldA}, indexEntry{platform: arm64, img: oldB})
+	reg.pushIndex(t, "new", "1", indexEntry{platform: amd64, img: newA})
+
+	for _, tc := range []struct {
+		policy MissingPlatformPolicy
+		// pushed are the digests the new index should list.
+		pushed func(res *IndexResult) []v1.Hash
+	}{
+		{policy: MissingPlatformFail},
+		{policy: MissingPlatformDrop, pushed: func(res *IndexResult) []v1.Hash {
+			return []v1.Hash{res.Platforms[0].Result.Digest}
+		}},
+		{policy: MissingPlatformCarry, pushed: func(res *IndexResult) []v1.Hash {
+			// The attestation of the carried image stays valid.
+			return []v1.Hash{res.Platforms[0].Result.Digest, mustDigest(t, origB), res.Platforms[3].Attestation}
+		}},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			r := New(nil, nil, WithMissingPlatformPolicy(tc.policy))
+			tag := tc.policy.String()
+			res, err := r.RebaseIndex(context.Background(), reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:"+tag)
+			if tc.pushed == nil {
+				var perr *PlatformNotFoundError
+				if !errors.As(err, &perr) || platformString(perr.Platform) != platformString(arm64) {
+					t.Errorf("RebaseIndex() = %v, want a *PlatformNotFoundError for %s", err, platformString(arm64))
+				}
+				if reg.has("out", tag) {
+					t.Error("index was pushed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RebaseIndex() = %v", err)
+			}
+			if len(res.Platforms) != 4 {
+				t.Fatalf("Platforms = %+v, want 4 entries", res.Platforms)
+			}
+			checkRebasedOnto(t, res.Platforms[0].Result, origA, newA)
+			missing := res.Platforms[1]
+			if !errors.Is(missing.Missing, ErrPlatformNotFound) || missing.Dropped != (tc.policy == MissingPlatformDrop) {
+				t.Errorf("arm64 = %+v", missing)
+			}
+			if att := res.Platforms[2]; !att.Dropped || att.Attestation != mustDigest(t, origA) {
+				t.Errorf("attestation of the rebased image = %+v, want it dropped", att)
+			}
+			if att := res.Platforms[3]; att.Dropped != (tc.policy == MissingPlatformDrop) || att.Attestation != mustDigest(t, origB) {
+				t.Errorf("attestation of the missing image = %+v", att)
+			}
+
+			want := tc.pushed(res)
+			m := reg.pushedIndex(t, "out", tag)
+			if len(m.Manifests) != len(want) {
+				t.Fatalf("pushed index has %d entries, want %d", len(m.Manifests), len(want))
+			}
+			for i, d := range m.Manifests {
+				if i == 2 {
+					// The attestation is listed by its own digest.
+					if d.Annotations[referenceDigestAnnotation] != want[i].String() {
+						t.Errorf("pushed entry %d attests to %s, want %s", i, d.Annotations[referenceDigestAnnotation], want[i])
+					}
+					continue
+				}
+				if d.Digest != want[i] {
+					t.Errorf("pushed entry %d = %s, want %s", i, d.Digest, want[i])
+				}
+			}
+			reg.checkChildPlatforms(t, "out", m)
+		})
+	}
+}
+
+func TestRebaseWithPlatformFetchesOnce(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, oldBase, newBase := testImages(t)
+	other, _, _ := testImages(t)
+	reg.pushIndex(t, "app", "1", indexEntry{platform: amd64, img: other}, indexEntry{platform: arm64, img: orig})
+	reg.push(t, "old:1", oldBase)
+	reg.push(t, "new:1", newBase)
+
+	res, err := New(nil, nil, WithPlatform(arm64)).Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	checkRebasedOnto(t, res, orig, newBase)
+	// The index and the image it lists for the platform.
+	if n := reg.count("GET", "/v2/app/manifests/"); n != 2 {
+		t.Errorf("original manifest fetched %d times, want 2", n)
+	}
+	// The image at a tag is fetched once, although an index was acceptable.
+	if n := reg.count("GET", "/v2/new/manifests/"); n != 1 {
+		t.Errorf("new base manifest fetched %d times, want 1", n)
+	}
+}
+
+func TestRebaseIndexNested(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, oldBase, newBase := platformImages(t, amd64)
+	reg.pushIndex(t, "inner", "1", indexEntry{platform: amd64, img: orig})
+	inner := reg.pushedIndex(t, "inner", "1")
+	raw, err := json.Marshal(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := v1.NewHash(digestOf(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, err := json.Marshal(v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     []v1.Descriptor{{MediaType: types.OCIImageIndex, Size: int64(len(raw)), Digest: h, Platform: &amd64}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.mu.Lock()
+	reg.putManifest("app", "nested", raw, string(types.OCIImageIndex))
+	reg.putManifest("app", "1", outer, string(types.OCIImageIndex))
+	reg.mu.Unlock()
+	reg.pushIndex(t, "old", "1", indexEntry{platform: amd64, img: oldBase})
+	reg.pushIndex(t, "new", "1", indexEntry{platform: amd64, img: newBase})
+
+	_, err = New(nil, nil, WithMissingPlatformPolicy(MissingPlatformCarry)).RebaseIndex(context.Background(), reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	if err == nil || !strings.Contains(err.Error(), "nested index") {
+		t.Errorf("RebaseIndex() = %v, want a nested index error", err)
+	}
+	if reg.has("out", "1") {
+		t.Error("index was pushed")
+	}
+}
+
+func TestRebaseIndexLabelSkipsAttestation(t *testing.T) {
+	reg := newTestRegistry(t)
+	origA, oldA, newA := testImages(t)
+	cfg, err := origA.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Config.Labels = map[string]string{"rebase": reg.host + "/old:1 " + reg.host + "/new:1"}
+	if origA, err = mutate.Config(origA, cfg.Config); err != nil {
+		t.Fatal(err)
+	}
+	origA, oldA, newA = withConfigPlatform(t, origA, amd64), withConfigPlatform(t, oldA, amd64), withConfigPlatform(t, newA, amd64)
+	other, _, _ := platformImages(t, arm64)
+
+	// The attestation is listed first, and between the images.
+	reg.pushIndex(t, "app", "1", attestationFor(t, origA), indexEntry{platform: amd64, img: origA}, attestationFor(t, other), indexEntry{platform: arm64, img: other})
+	reg.pushIndex(t, "old", "1", indexEntry{platform: amd64, img: oldA})
+	reg.pushIndex(t, "new", "1", indexEntry{platform: amd64, img: newA})
+
+	r := New(nil, nil, WithMissingPlatformPolicy(MissingPlatformCarry))
+	res, err := r.RebaseIndex(context.Background(), reg.host+"/app:1", "", "", reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("RebaseIndex() = %v", err)
+	}
+	if len(res.Platforms) != 4 {
+		t.Fatalf("Platforms = %+v, want 4 entries", res.Platforms)
+	}
+	if att := res.Platforms[0]; !att.Dropped || att.Attestation != mustDigest(t, origA) {
+		t.Errorf("Platforms[0] = %+v, want the dropped attestation of the rebased image", att)
+	}
+	checkRebasedOnto(t, res.Platforms[1].Result, origA, newA)
+	if att := res.Platforms[2]; att.Dropped || att.Attestation != mustDigest(t, other) {
+		t.Errorf("Platforms[2] = %+v, want the kept attestation of the carried image", att)
+	}
+	if res.Platforms[3].Missing == nil || res.Platforms[3].Dropped {
+		t.Errorf("Platforms[3] = %+v, want the carried image", res.Platforms[3])
+	}
+
+	// The kept entries stay in their order.
+	m := reg.pushedIndex(t, "out", "1")
+	if len(m.Manifests) != 3 {
+		t.Fatalf("pushed index has %d entries, want 3", len(m.Manifests))
+	}
+	if m.Manifests[0].Digest != res.Platforms[1].Result.Digest || !isAttestation(m.Manifests[1]) || m.Manifests[2].Digest != mustDigest(t, other) {
+		t.Errorf("pushed entries = %+v, want the rebased image, the attestation and the carried image", m.Manifests)
+	}
+}
+
+func TestRebaseIndexFormatCarried(t *testing.T) {
+	reg := newTestRegistry(t)
+	origA, oldA, newA := platformImages(t, amd64)
+	origB, oldB, _ := platformImages(t, arm64)
+	reg.pushIndex(t, "app", "1", indexEntry{platform: amd64, img: origA}, indexEntry{platform: arm64, img: origB}, attestationFor(t, origB))
+	reg.pushIndex(t, "old", "1", indexEntry{platform: amd64, img: oldA}, indexEntry{platform: arm64, img: oldB})
+	reg.pushIndex(t, "new", "1", indexEntry{platform: amd64, img: newA})
+
+	r := New(nil, nil, WithMissingPlatformPolicy(MissingPlatformCarry), WithFormat(OCIFormat))
+	res, err := r.RebaseIndex(context.Background(), reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("RebaseIndex() = %v", err)
+	}
+	// The carried image is converted, so its attestation no longer holds.
+	if att := res.Platforms[2]; !att.Dropped {
+		t.Errorf("attestation of the converted image = %+v, want it dropped", att)
+	}
+
+	m := reg.pushedIndex(t, "out", "1")
+	if m.MediaType != types.OCIImageIndex || len(m.Manifests) != 2 {
+		t.Fatalf("pushed index = %+v, want an OCI index of 2 images", m)
+	}
+	for i, d := range m.Manifests {
+		if d.MediaType != types.OCIManifestSchema1 {
+			t.Errorf("pushed entry %d has media type %s, want %s", i, d.MediaType, types.OCIManifestSchema1)
+		}
+		reg.mu.Lock()
+		raw, ok := reg.manifests["out"][d.Digest.String()]
+		reg.mu.Unlock()
+		if !ok {
+			t.Fatalf("pushed entry %d was not pushed", i)
+		}
+		cm, err := v1.ParseManifest(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cm.MediaType != types.OCIManifestSchema1 || cm.Config.MediaType != types.OCIConfigJSON {
+			t.Errorf("pushed image %d has media types %s and %s", i, cm.MediaType, cm.Config.MediaType)
+		}
+	}
+	reg.checkChildPlatforms(t, "out", m)
+}
@@ -0,0 +1,367 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/v1util"
+)
+
+// layoutScheme prefixes references to OCI image-layout directories, in the
+// form oci:<dir>[:<ref name>] or oci:<dir>@<digest>.
+const layoutScheme = "oci:"
+
+// refNameAnnotation names a manifest in an image layout's index.json.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// layoutRef is a parsed reference into an image layout.
+type layoutRef struct {
+	dir string
+	// name selects a manifest by its ref name annotation.
+	name string
+	// digest selects a manifest by digest.
+	digest *v1.Hash
+}
+
+// parseLayoutRef parses a layout reference without its scheme. The
+// directory may contain "@" and ":", since a digest or ref name follows the
+// last of them, after the last "/".
+func parseLayoutRef(s string) (layoutRef, error) {
+	if i := strings.LastIndex(s, "@"); i > strings.LastIndex(s, "/") {
+		h, err := v1.NewHash(s[i+1:])
+		if err != nil {
+			return layoutRef{}, err
+		}
+		return layoutRef{dir: s[:i], digest: &h}, nil
+	}
+	if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		return layoutRef{dir: s[:i], name: s[i+1:]}, nil
+	}
+	return layoutRef{dir: s}, nil
+}
+
+func (l layoutRef) String() string {
+	switch {
+	case l.digest != nil:
+		return layoutScheme + l.dir + "@" + l.digest.String()
+	case l.name != "":
+		return layoutScheme + l.dir + ":" + l.name
+	}
+	return layoutScheme + l.dir
+}
+
+func (l layoutRef) blobPath(h v1.Hash) string {
+	return filepath.Join(l.dir, "blobs", h.Algorithm, h.Hex)
+}
+
+// readBlob reads the blob h, checking that its contents have that digest.
+func (l layoutRef) readBlob(h v1.Hash) ([]byte, error) {
+	rc, err := l.openBlob(h)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// openBlob opens the blob h. Reading it fails at the end if its contents do
+// not have that digest.
+func (l layoutRef) openBlob(h v1.Hash) (io.ReadCloser, error) {
+	f, err := os.Open(l.blobPath(h))
+	if err != nil {
+		return nil, err
+	}
+	rc, err := v1util.VerifyReadCloser(f, h)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// layoutImage reads an image from an image layout. When the selected
+// descriptor is itself an index, the manifest for the Rebaser's platform is
+// taken from it.
+func (r Rebaser) layoutImage(s string) (v1.Image, error) {
+	l, err := parseLayoutRef(s)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(l.dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	index, err := v1.ParseIndexManifest(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	desc, err := l.find(index)
+	if err != nil {
+		return nil, err
+	}
+	if desc.MediaType == types.OCIImageIndex || desc.MediaType == types.DockerManifestList {
+		b, err := l.readBlob(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		child, err := v1.ParseIndexManifest(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		if desc, err = r.matchPlatform(l.String(), child); err != nil {
+			return nil, err
+		}
+	}
+	raw, err := l.readBlob(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return partial.CompressedToImage(&layoutImage{ref: l, mediaType: desc.MediaType, manifest: raw})
+}
+
+// find returns the descriptor in index that l selects.
+func (l layoutRef) find(index *v1.IndexManifest) (*v1.Descriptor, error) {
+	var found []v1.Descriptor
+	for _, desc := range index.Manifests {
+		switch {
+		case l.digest != nil && desc.Digest == *l.digest,
+			l.name != "" && desc.Annotations[refNameAnnotation] == l.name,
+			l.digest == nil && l.name == "":
+			found = append(found, desc)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no manifest matching %s", l)
+	case 1:
+		return &found[0], nil
+	}
+	return nil, fmt.Errorf("%d manifests match %s, select one by ref name or digest", len(found), l)
+}
+
+// layoutImage implements partial.CompressedImageCore
+type layoutImage struct {
+	ref       layoutRef
+	mediaType types.MediaType
+	manifest  []byte
+}
+
+// MediaType implements partial.CompressedImageCore
+func (i *layoutImage) MediaType() (types.MediaType, error) {
+	if i.mediaType == "" {
+		return types.OCIManifestSchema1, nil
+	}
+	return i.mediaType, nil
+}
+
+// RawManifest implements partial.CompressedImageCore
+func (i *layoutImage) RawManifest() ([]byte, error) {
+	return i.manifest, nil
+}
+
+// RawConfigFile implements partial.CompressedImageCore
+func (i *layoutImage) RawConfigFile() ([]byte, error) {
+	m, err := partial.Manifest(i)
+	if err != nil {
+		return nil, err
+	}
+	return i.ref.readBlob(m.Config.Digest)
+}
+
+// LayerByDigest implements partial.CompressedImageCore
+func (i *layoutImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	return &layoutLayer{img: i, digest: h}, nil
+}
+
+// layoutLayer implements partial.CompressedLayer
+type layoutLayer struct {
+	img    *layoutImage
+	digest v1.Hash
+}
+
+// Digest implements partial.CompressedLayer
+func (l *layoutLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+// Compressed implements partial.CompressedLayer
+func (l *layoutLayer) Compressed() (io.ReadCloser, error) {
+	return l.img.ref.openBlob(l.digest)
+}
+
+// Size implements partial.CompressedLayer
+func (l *layoutLayer) Size() (int64, error) {
+	m, err := partial.Manifest(l.img)
+	if err != nil {
+		return 0, err
+	}
+	if m.Config.Digest == l.digest {
+		return m.Config.Size, nil
+	}
+	for _, desc := range m.Layers {
+		if desc.Digest == l.digest {
+			return desc.Size, nil
+		}
+	}
+	return 0, fmt.Errorf("blob %v not found in manifest", l.digest)
+}
+
+// writeLayout writes img into the image layout l refers to, creating the
+// layout if necessary. If l has a ref name, any manifest previously
+// annotated with it is replaced in index.json.
+func writeLayout(l layoutRef, img v1.Image) error {
+	if err := os.MkdirAll(filepath.Join(l.dir, "blobs"), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(l.dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return err
+	}
+
+	// Write the layers, then the config and the manifest that refer to them.
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		h, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		if err := l.writeBlob(h, layer.Compressed); err != nil {
+			return err
+		}
+	}
+	cfgName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	cfg, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := l.writeBlob(cfgName, bytesOpener(cfg)); err != nil {
+		return err
+	}
+	h, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	if err := l.writeBlob(h, bytesOpener(raw)); err != nil {
+		return err
+	}
+	mt, err := img.MediaType()
+	if err != nil {
+		return err
+	}
+
+	desc := v1.Descriptor{MediaType: mt, Size: int64(len(raw)), Digest: h}
+	if l.name != "" {
+		desc.Annotations = map[string]string{refNameAnnotation: l.name}
+	}
+	return l.addToIndex(desc)
+}
+
+// addToIndex adds desc to the layout's index.json, replacing any manifest
+// with the same ref name, or the same digest and no ref name.
+func (l layoutRef) addToIndex(desc v1.Descriptor) error {
+	index := &v1.IndexManifest{SchemaVersion: 2}
+	b, err := ioutil.ReadFile(filepath.Join(l.dir, "index.json"))
+	switch {
+	case err == nil:
+		if index, err = v1.ParseIndexManifest(bytes.NewReader(b)); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	manifests := index.Manifests[:0]
+	for _, m := range index.Manifests {
+		name := m.Annotations[refNameAnnotation]
+		if (l.name != "" && name == l.name) || (name == "" && l.name == "" && m.Digest == desc.Digest) {
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	index.Manifests = append(manifests, desc)
+
+	b, err = json.MarshalIndent(index, "", "   ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(l.dir, "index.json"), bytes.NewReader(b))
+}
+
+// writeBlob writes the blob h, as read from open, unless it already exists.
+func (l layoutRef) writeBlob(h v1.Hash, open func() (io.ReadCloser, error)) error {
+	path := l.blobPath(h)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return writeFileAtomic(path, rc)
+}
+
+func bytesOpener(b []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+// writeFileAtomic writes the contents of r to path by way of a temporary
+// file, so that readers never observe a partial file.
+func writeFileAtomic(path string, r io.Reader) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
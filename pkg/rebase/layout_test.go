@@ -0,0 +1,159 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// testLayout writes the images from testImages to a new image layout, under
+// the ref names app, old and new.
+func testLayout(t *testing.T) (dir string, orig, oldBase, newBase v1.Image) {
+	t.Helper()
+	dir = t.TempDir()
+	orig, oldBase, newBase = testImages(t)
+	for name, img := range map[string]v1.Image{"app": orig, "old": oldBase, "new": newBase} {
+		if err := writeLayout(layoutRef{dir: dir, name: name}, img); err != nil {
+			t.Fatalf("writeLayout(%s) = %v", name, err)
+		}
+	}
+	return dir, orig, oldBase, newBase
+}
+
+func TestParseLayoutRef(t *testing.T) {
+	h := "sha256:" + zeros
+	for _, tc := range []struct {
+		in, dir, name, digest string
+	}{
+		{in: "dir", dir: "dir"},
+		{in: "dir:app", dir: "dir", name: "app"},
+		{in: "dir@" + h, dir: "dir", digest: h},
+		{in: "a:b/dir", dir: "a:b/dir"},
+		{in: "a:b/dir:app", dir: "a:b/dir", name: "app"},
+		{in: "a@b/dir", dir: "a@b/dir"},
+		{in: "a@b:c/dir@" + h, dir: "a@b:c/dir", digest: h},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			l, err := parseLayoutRef(tc.in)
+			if err != nil {
+				t.Fatalf("parseLayoutRef() = %v", err)
+			}
+			digest := ""
+			if l.digest != nil {
+				digest = l.digest.String()
+			}
+			if l.dir != tc.dir || l.name != tc.name || digest != tc.digest {
+				t.Errorf("parseLayoutRef() = %q, %q, %q, want %q, %q, %q", l.dir, l.name, digest, tc.dir, tc.name, tc.digest)
+			}
+		})
+	}
+	if _, err := parseLayoutRef("dir@sha256:123"); err == nil {
+		t.Error("parseLayoutRef() with a bad digest succeeded")
+	}
+}
+
+func TestLayoutColonInPath(t *testing.T) {
+	orig, oldBase, newBase := testImages(t)
+	dir := filepath.Join(t.TempDir(), "a:b")
+	for name, img := range map[string]v1.Image{"app": orig, "old": oldBase, "new": newBase} {
+		if err := writeLayout(layoutRef{dir: dir, name: name}, img); err != nil {
+			t.Fatalf("writeLayout(%s) = %v", name, err)
+		}
+	}
+	r := New(nil, nil)
+	res, err := r.Rebase("oci:"+dir+":app", "oci:"+dir+":old", "oci:"+dir+":new", "oci:"+dir+":out")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	img, err := r.layoutImage(dir + ":out")
+	if err != nil {
+		t.Fatalf("layoutImage(out) = %v", err)
+	}
+	if got := mustDigest(t, img); got != res.Digest {
+		t.Errorf("out has digest %s, want %s", got, res.Digest)
+	}
+}
+
+func TestLayoutRoundTrip(t *testing.T) {
+	dir, orig, _, _ := testLayout(t)
+	r := New(nil, nil)
+
+	res, err := r.Rebase("oci:"+dir+":app", "oci:"+dir+":old", "oci:"+dir+":new", "oci:"+dir+":out")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	if res.Original != mustDigest(t, orig) {
+		t.Errorf("Original = %s, want %s", res.Original, mustDigest(t, orig))
+	}
+	img, err := r.layoutImage(dir + ":out")
+	if err != nil {
+		t.Fatalf("layoutImage(out) = %v", err)
+	}
+	if got := mustDigest(t, img); got != res.Digest {
+		t.Errorf("out has digest %s, want %s", got, res.Digest)
+	}
+	if _, err := r.layoutImage(dir + "@" + res.Digest.String()); err != nil {
+		t.Errorf("layoutImage(@digest) = %v", err)
+	}
+}
+
+func TestLayoutTampered(t *testing.T) {
+	// Each blob is replaced by another valid one, so that only the digest
+	// check can notice.
+	for _, test := range []struct {
+		desc       string
+		blob, with func(orig, newBase *v1.Manifest) v1.Hash
+	}{{
+		desc: "config",
+		blob: func(orig, newBase *v1.Manifest) v1.Hash { return orig.Config.Digest },
+		with: func(orig, newBase *v1.Manifest) v1.Hash { return newBase.Config.Digest },
+	}, {
+		desc: "layer",
+		blob: func(orig, newBase *v1.Manifest) v1.Hash { return orig.Layers[len(orig.Layers)-1].Digest },
+		with: func(orig, newBase *v1.Manifest) v1.Hash { return newBase.Layers[0].Digest },
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			dir, orig, _, newBase := testLayout(t)
+			om, err := orig.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			nm, err := newBase.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := layoutRef{dir: dir}
+			b, err := ioutil.ReadFile(l.blobPath(test.with(om, nm)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(l.blobPath(test.blob(om, nm)), b, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = New(nil, nil).Rebase("oci:"+dir+":app", "oci:"+dir+":old", "oci:"+dir+":new", "oci:"+filepath.Join(t.TempDir(), "out"))
+			if err == nil || !strings.Contains(err.Error(), "checksum") {
+				t.Errorf("Rebase() with tampered %s = %v, want checksum error", test.desc, err)
+			}
+		})
+	}
+}
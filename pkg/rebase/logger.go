@@ -0,0 +1,175 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Logger receives structured events about a rebase. Each method takes a
+// message followed by alternating keys and values, so a *slog.Logger can be
+// used directly and callers can filter events by level.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+}
+
+// WithLogger reports label discovery, image resolution, layer matching and
+// push outcomes to l, and each blob a push checks, mounts or uploads at debug
+// level. By default nothing is logged.
+//
+// The vendored registry packages write those blob events, and their
+// fallbacks to anonymous access, to the standard logger. While a rebase is
+// running they are taken from the standard logger and reported to l instead;
+// anything else written to the standard logger meanwhile is passed on.
+func WithLogger(l Logger) Option {
+	return func(r *Rebaser) {
+		r.logger = l
+	}
+}
+
+// nopLogger discards every event.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+
+// stdLog takes over the output of the standard logger while rebases are
+// running, to report what the vendored registry packages write to it.
+var stdLog logBridge
+
+// logBridge reports the lines the vendored packages write to the standard
+// logger to the Loggers of the running rebases, and writes every other line
+// where the standard logger wrote before.
+type logBridge struct {
+	// setup serializes taking over and restoring the standard logger. It is
+	// never held by Write, which the standard logger calls under its own
+	// lock.
+	setup sync.Mutex
+
+	mu      sync.Mutex
+	loggers map[int]Logger
+	next    int
+	// prev writes with the output, flags and prefix the standard logger
+	// had before it was taken over.
+	prev *log.Logger
+}
+
+// capture reports the vendored packages' lines to l until the returned
+// function is called. A line written while several rebases are running is
+// reported to each of their Loggers, since it cannot be attributed to one.
+func (b *logBridge) capture(l Logger) func() {
+	b.setup.Lock()
+	defer b.setup.Unlock()
+	b.mu.Lock()
+	first := len(b.loggers) == 0
+	b.mu.Unlock()
+	// The standard logger is only read and set without b.mu held.
+	var prev *log.Logger
+	if first {
+		prev = log.New(log.Writer(), log.Prefix(), log.Flags())
+	}
+	b.mu.Lock()
+	if first {
+		b.prev = prev
+		b.loggers = map[int]Logger{}
+	}
+	id := b.next
+	b.next++
+	b.loggers[id] = l
+	b.mu.Unlock()
+	if first {
+		log.SetOutput(b)
+		log.SetFlags(0)
+		log.SetPrefix("")
+	}
+
+	return func() {
+		b.setup.Lock()
+		defer b.setup.Unlock()
+		b.mu.Lock()
+		delete(b.loggers, id)
+		prev := b.prev
+		last := len(b.loggers) == 0
+		b.mu.Unlock()
+		if last {
+			log.SetOutput(prev.Writer())
+			log.SetFlags(prev.Flags())
+			log.SetPrefix(prev.Prefix())
+		}
+	}
+}
+
+// Write implements io.Writer
+func (b *logBridge) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	loggers := make([]Logger, 0, len(b.loggers))
+	for _, l := range b.loggers {
+		loggers = append(loggers, l)
+	}
+	prev := b.prev
+	b.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		msg, args, ok := vendorEvent(line)
+		if !ok {
+			prev.Print(line)
+			continue
+		}
+		for _, l := range loggers {
+			l.Debug(msg, args...)
+		}
+	}
+	return len(p), nil
+}
+
+// vendorEvents are the lines the vendored packages log, by prefix, and the
+// events they are reported as. The rest of the line is the value of key.
+var vendorEvents = []struct {
+	prefix, msg, key string
+}{
+	{"existing blob: ", "existing blob", "digest"},
+	{"mounted blob: ", "mounted blob", "digest"},
+	{"pushed blob: ", "pushed blob", "digest"},
+	{"existing manifest: ", "existing manifest", "digest"},
+	{"Unable to ", "using anonymous access", "error"},
+	{"No matching credentials were found", "using anonymous access", "error"},
+}
+
+// vendorEvent returns the event a line logged by the vendored packages is
+// reported as, or false if they did not log it.
+func vendorEvent(line string) (string, []interface{}, bool) {
+	for _, e := range vendorEvents {
+		if strings.HasPrefix(line, e.prefix) {
+			return e.msg, []interface{}{e.key, strings.TrimPrefix(line, e.prefix)}, true
+		}
+	}
+	// remote.Write ends with "<ref>: digest: <digest> size: <size>".
+	if i := strings.Index(line, ": digest: "); i > 0 {
+		var h string
+		var size int
+		if _, err := fmt.Sscanf(line[i+len(": digest: "):], "%s size: %d", &h, &size); err == nil {
+			return "pushed manifest", []interface{}{"ref", line[:i], "digest", h, "size", size}, true
+		}
+	}
+	return "", nil, false
+}
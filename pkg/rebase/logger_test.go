@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger records the messages it is given.
+type recordingLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) record(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record(msg) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record(msg) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record(msg) }
+
+func (l *recordingLogger) has(msg string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.msgs {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+// quietStandardLogger redirects the standard logger for the rest of the
+// test and returns what is written to it.
+func quietStandardLogger(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestNothingLoggedByDefault(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	// The default keychain has no Docker config to read.
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	buf := quietStandardLogger(t)
+
+	if _, err := New(nil, nil).Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/app:2", reg.host+"/app:3"); err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("standard logger got %q, want nothing", buf.String())
+	}
+}
+
+func TestLoggerGetsPushEvents(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	buf := quietStandardLogger(t)
+
+	l := &recordingLogger{}
+	if _, err := New(nil, nil, WithLogger(l)).Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1"); err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	for _, msg := range []string{"using anonymous access", "resolved image", "pushed blob", "pushed image"} {
+		if !l.has(msg) {
+			t.Errorf("no %q event in %q", msg, l.msgs)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("standard logger got %q, want nothing", buf.String())
+	}
+}
+
+func TestStandardLoggerTakenOver(t *testing.T) {
+	buf := quietStandardLogger(t)
+	a, b := &recordingLogger{}, &recordingLogger{}
+	releaseA := stdLog.capture(a)
+	releaseB := stdLog.capture(b)
+
+	log.Printf("pushed blob: %s", "sha256:abc")
+	log.Printf("%v: digest: %v size: %d", "example.com/app:1", "sha256:def", 12)
+	log.Print("unrelated")
+	releaseB()
+	log.Printf("mounted blob: %s", "sha256:abc")
+	releaseA()
+	log.Printf("existing blob: %s", "sha256:abc")
+
+	for _, msg := range []string{"pushed blob", "pushed manifest", "mounted blob"} {
+		if !a.has(msg) {
+			t.Errorf("no %q event in %q", msg, a.msgs)
+		}
+	}
+	if !b.has("pushed blob") || b.has("mounted blob") {
+		t.Errorf("second logger got %q, want only the events while it was capturing", b.msgs)
+	}
+	if a.has("existing blob") {
+		t.Error("event reported after the rebase was over")
+	}
+	out := buf.String()
+	if !strings.Contains(out, "unrelated") || !strings.Contains(out, "existing blob") || strings.Contains(out, "pushed blob") {
+		t.Errorf("standard logger got %q, want only the unrelated line and the one after the rebase", out)
+	}
+	if log.Writer() != buf {
+		t.Error("standard logger output was not restored")
+	}
+}
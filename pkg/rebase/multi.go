@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// PlatformInput names a single-platform original image and the bases to
+// rebase it from and onto.
+type PlatformInput struct {
+	// Original is the image to rebase. OldBase and NewBase are its bases,
+	// or are both empty to read them from the rebase LABEL of Original.
+	Original string
+	OldBase  string
+	NewBase  string
+}
+
+// RebaseMulti rebases each original in inputs, like Rebase, and pushes an
+// image index of the results to each reference in rebased. The entry for
+// each image takes its platform from the config of the original, so every
+// original must be for a different platform. A base that is an index is
+// resolved to its image for that platform. All of the references in rebased
+// must be in registries.
+//
+// The images themselves are only pushed as part of the index.
+func (r Rebaser) RebaseMulti(ctx context.Context, inputs []PlatformInput, rebasedStrs ...string) (*IndexResult, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("no image given to rebase")
+	}
+	dsts, err := r.indexDestinations(rebasedStrs)
+	if err != nil {
+		return nil, err
+	}
+
+	t := r.roundTripper(ctx)
+	defer t.close()
+	var res IndexResult
+	b := newIndexBuilder(&v1.IndexManifest{SchemaVersion: 2})
+	seen := map[string]string{}
+	for _, pi := range inputs {
+		in, err := r.resolvePlatform(ctx, t, pi.Original, pi.OldBase, pi.NewBase, true)
+		if err != nil {
+			return nil, err
+		}
+		p, err := configPlatform(in.orig)
+		if err != nil {
+			return nil, &RegistryError{Op: "get config for original image", Ref: pi.Original, Err: t.withStatus(err)}
+		}
+		ps := platformString(p)
+		if other, ok := seen[ps]; ok {
+			return nil, fmt.Errorf("%q and %q are both for platform %s", other, pi.Original, ps)
+		}
+		seen[ps] = pi.Original
+
+		rebased, pr, err := r.build(ctx, t, in)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.add(&v1.Descriptor{Platform: &p}, rebased); err != nil {
+			return nil, err
+		}
+		r.logger.Info("rebased platform", "platform", ps, "digest", pr.Digest.String())
+		res.Platforms = append(res.Platforms, PlatformResult{Platform: p, Result: pr})
+	}
+
+	idx, err := b.build(r.format)
+	if err != nil {
+		return nil, err
+	}
+	if res.Digest, err = idx.Digest(); err != nil {
+		return nil, err
+	}
+	return r.publishIndex(ctx, t, idx, &res, dsts)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRebaseMulti(t *testing.T) {
+	reg := newTestRegistry(t)
+	origA, oldA, newA := platformImages(t, amd64)
+	origB, oldB, newB := platformImages(t, arm64)
+	reg.push(t, "app:1-amd64", origA)
+	reg.push(t, "app:1-arm64", origB)
+	reg.pushIndex(t, "old", "1", indexEntry{platform: arm64, img: oldB}, indexEntry{platform: amd64, img: oldA})
+	reg.pushIndex(t, "new", "1", indexEntry{platform: amd64, img: newA}, indexEntry{platform: arm64, img: newB})
+	reg.pushIndex(t, "new", "amd64", indexEntry{platform: amd64, img: newA})
+
+	t.Run("paired", func(t *testing.T) {
+		res, err := New(nil, nil).RebaseMulti(context.Background(), []PlatformInput{
+			{Original: reg.host + "/app:1-amd64", OldBase: reg.host + "/old:1", NewBase: reg.host + "/new:1"},
+			{Original: reg.host + "/app:1-arm64", OldBase: reg.host + "/old:1", NewBase: reg.host + "/new:1"},
+		}, reg.host+"/out:1")
+		if err != nil {
+			t.Fatalf("RebaseMulti() = %v", err)
+		}
+		if len(res.Platforms) != 2 {
+			t.Fatalf("Platforms = %+v, want 2 entries", res.Platforms)
+		}
+		checkRebasedOnto(t, res.Platforms[0].Result, origA, newA)
+		checkRebasedOnto(t, res.Platforms[1].Result, origB, newB)
+
+		m := reg.pushedIndex(t, "out", "1")
+		if len(m.Manifests) != 2 {
+			t.Fatalf("pushed index has %d entries, want 2", len(m.Manifests))
+		}
+		for i, want := range []string{platformString(amd64), platformString(arm64)} {
+			if got := m.Manifests[i].Platform; got == nil || platformString(*got) != want {
+				t.Errorf("pushed entry %d is for %+v, want %s", i, got, want)
+			}
+		}
+		reg.checkChildPlatforms(t, "out", m)
+	})
+
+	t.Run("missing base platform", func(t *testing.T) {
+		_, err := New(nil, nil).RebaseMulti(context.Background(), []PlatformInput{
+			{Original: reg.host + "/app:1-amd64", OldBase: reg.host + "/old:1", NewBase: reg.host + "/new:amd64"},
+			{Original: reg.host + "/app:1-arm64", OldBase: reg.host + "/old:1", NewBase: reg.host + "/new:amd64"},
+		}, reg.host+"/out:2")
+		var perr *PlatformNotFoundError
+		if !errors.As(err, &perr) || platformString(perr.Platform) != platformString(arm64) {
+			t.Errorf("RebaseMulti() = %v, want a *PlatformNotFoundError for %s", err, platformString(arm64))
+		}
+		if reg.has("out", "2") {
+			t.Error("index was pushed")
+		}
+	})
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Option is a functional option for New.
+type Option func(*Rebaser)
+
+// WithKeychain overrides the keychain used to authenticate to registries.
+func WithKeychain(k authn.Keychain) Option {
+	return func(r *Rebaser) {
+		r.keychain = k
+	}
+}
+
+// WithTransport overrides the HTTP transport used to talk to registries.
+func WithTransport(t http.RoundTripper) Option {
+	return func(r *Rebaser) {
+		r.transport = t
+	}
+}
+
+// WithPlatform selects the platform of the images to rebase. The image for p
+// is chosen from every input that is a manifest list or image index,
+// matching its os and architecture, and its variant and os.version if p
+// gives them. Every input must provide p, or the rebase fails with a
+// *PlatformNotFoundError. Without this option linux/amd64 is chosen from
+// indexes, and single images are used whatever their platform.
+func WithPlatform(p v1.Platform) Option {
+	return func(r *Rebaser) {
+		r.platform = &p
+	}
+}
+
+// WithoutPlatformCheck allows an image to be rebased onto a new base for a
+// different platform. By default the os, architecture, variant and
+// os.version in their configs must agree.
+func WithoutPlatformCheck() Option {
+	return func(r *Rebaser) {
+		r.anyPlatform = true
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every registry request.
+func WithUserAgent(ua string) Option {
+	return func(r *Rebaser) {
+		r.userAgent = ua
+	}
+}
+
+// WithRetry retries registry requests that fail transiently according to p.
+// By default requests are not retried.
+func WithRetry(p RetryPolicy) Option {
+	return func(r *Rebaser) {
+		r.retry = p
+	}
+}
+
+// WithNameValidation sets how strictly image references are validated. The
+// default is name.WeakValidation.
+func WithNameValidation(s name.Strictness) Option {
+	return func(r *Rebaser) {
+		r.strictness = s
+	}
+}
+
+// WithTimeouts bounds each phase of a rebase by the corresponding duration
+// in t.
+func WithTimeouts(t Timeouts) Option {
+	return func(r *Rebaser) {
+		r.timeouts = t
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestNameValidation(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, _, _ := reg.pushTestImages(t)
+	reg.push(t, "app:latest", orig)
+	for _, tc := range []struct {
+		desc       string
+		strictness name.Strictness
+		orig       string
+		ok         bool
+	}{
+		{desc: "weak, implicit tag", strictness: name.WeakValidation, orig: reg.host + "/app", ok: true},
+		{desc: "strict, implicit tag", strictness: name.StrictValidation, orig: reg.host + "/app"},
+		{desc: "strict, explicit tag", strictness: name.StrictValidation, orig: reg.host + "/app:1", ok: true},
+		{desc: "weak, invalid", strictness: name.WeakValidation, orig: reg.host + "/App:1"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := New(nil, nil, WithNameValidation(tc.strictness))
+			_, err := r.Rebase(tc.orig, reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+			if ok := err == nil; ok != tc.ok {
+				t.Errorf("Rebase(%q) = %v, want success %t", tc.orig, err, tc.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/sync/errgroup"
+)
+
+// Plan describes the image a rebase would push, without it having been
+// pushed. Reference and References are the destinations it would be pushed
+// to.
+type Plan struct {
+	Result
+
+	// OriginalRef, OldBaseRef and NewBaseRef are the references the inputs
+	// were resolved from. The bases are those named by the original's
+	// rebase LABEL if none were given.
+	OriginalRef string
+	OldBaseRef  string
+	NewBaseRef  string
+
+	// Added are the new base layers the rebased image gains, and Removed
+	// the old base layers it loses.
+	Added   []v1.Descriptor
+	Removed []v1.Descriptor
+
+	// Existing are the blobs of the rebased image, including its config,
+	// that the first registry destination already holds and that would not
+	// be uploaded.
+	Existing []v1.Hash
+
+	// Options are the options of the Rebaser that determine the rebased
+	// image.
+	Options PlanOptions
+}
+
+// Plan resolves orig, oldBase and newBase and builds the image that Rebase
+// would push to rebased, but does not push it. The repository of the first
+// registry destination is only read, to find out which blobs it already
+// holds; that check is bounded by the Push timeout.
+func (r Rebaser) Plan(ctx context.Context, origStr, oldBaseStr, newBaseStr string, rebasedStrs ...string) (*Plan, error) {
+	dsts, err := r.parseDestinations(rebasedStrs)
+	if err != nil {
+		return nil, err
+	}
+
+	t := r.roundTripper(ctx)
+	defer t.close()
+	in, err := r.resolve(ctx, t, origStr, oldBaseStr, newBaseStr)
+	if err != nil {
+		return nil, err
+	}
+	rebased, res, err := r.build(ctx, t, in)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dsts {
+		if d.sink != nil {
+			res.References = append(res.References, d.str)
+			continue
+		}
+		if d.layout != nil {
+			res.References = append(res.References, d.layout.String())
+			continue
+		}
+		ref, err := d.resolve(res.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("could not plan push to %q: %w", d.str, err)
+		}
+		res.References = append(res.References, d.name(ref))
+	}
+	res.Reference = res.References[0]
+
+	p := &Plan{
+		Result:      *res,
+		OriginalRef: in.origStr,
+		OldBaseRef:  in.oldBaseStr,
+		NewBaseRef:  in.newBaseStr,
+		Options:     r.planOptions(),
+	}
+	oldBaseManifest, err := in.oldBase.Manifest()
+	if err != nil {
+		return nil, &RegistryError{Op: "get manifest for old base image", Ref: in.oldBaseStr, Err: t.withStatus(err)}
+	}
+	p.Removed = oldBaseManifest.Layers
+	newBaseManifest, err := in.newBase.Manifest()
+	if err != nil {
+		return nil, &RegistryError{Op: "get manifest for new base image", Ref: in.newBaseStr, Err: t.withStatus(err)}
+	}
+	p.Added = newBaseManifest.Layers
+
+	for _, d := range dsts {
+		if !d.registry() {
+			continue
+		}
+		pushCtx, cancel := t.phase(ctx, r.timeouts.Push)
+		defer cancel()
+		if p.Existing, err = r.existingBlobs(t, d.repo, rebased); err != nil {
+			if ctxErr := pushCtx.Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			return nil, &RegistryError{Op: "check existing blobs in", Ref: d.repo.String(), Err: t.withStatus(err)}
+		}
+		break
+	}
+	return p, nil
+}
+
+// existingBlobs returns the blobs of img, in manifest order with the config
+// first, that already exist in repo.
+func (r Rebaser) existingBlobs(t *contextTransport, repo name.Repository, img v1.Image) ([]v1.Hash, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	blobs := []v1.Hash{m.Config.Digest}
+	for _, l := range m.Layers {
+		blobs = append(blobs, l.Digest)
+	}
+
+	client, err := r.client(t, repo, transport.PullScope)
+	if err != nil {
+		return nil, err
+	}
+	exists := make([]bool, len(blobs))
+	var g errgroup.Group
+	for i, h := range blobs {
+		i, h := i, h
+		g.Go(func() error {
+			ok, err := blobExists(client, repo, h)
+			if err != nil {
+				return err
+			}
+			exists[i] = ok
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var existing []v1.Hash
+	for i, h := range blobs {
+		if exists[i] {
+			existing = append(existing, h)
+		}
+	}
+	return existing, nil
+}
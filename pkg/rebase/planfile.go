@@ -0,0 +1,185 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// PlanFile is a reviewable record of a planned rebase. It pins the digests
+// of the inputs and of the image the rebase is expected to produce, so that
+// Apply can refuse to push if anything changed after the plan was approved.
+type PlanFile struct {
+	Original PinnedImage `json:"original"`
+	OldBase  PinnedImage `json:"oldBase"`
+	NewBase  PinnedImage `json:"newBase"`
+	// Destinations are the references the rebased image is pushed to.
+	Destinations []string `json:"destinations"`
+	// Digest is the digest the rebased image is expected to have.
+	Digest v1.Hash `json:"digest"`
+	// Options are the options the plan was made with.
+	Options PlanOptions `json:"options"`
+}
+
+// PlanOptions are the options of a Rebaser that determine the image a rebase
+// produces, or whether it produces one at all.
+type PlanOptions struct {
+	// Format is the format selected with WithFormat.
+	Format Format `json:"format"`
+	// Platform is the platform selected with WithPlatform, if any.
+	Platform *v1.Platform `json:"platform,omitempty"`
+	// NoPlatformCheck is set by WithoutPlatformCheck.
+	NoPlatformCheck bool `json:"noPlatformCheck,omitempty"`
+}
+
+// String describes o.
+func (o PlanOptions) String() string {
+	p := "any platform"
+	if o.Platform != nil {
+		p = "platform " + platformString(*o.Platform)
+	}
+	s := fmt.Sprintf("format %s and %s", o.Format, p)
+	if o.NoPlatformCheck {
+		s += " without platform check"
+	}
+	return s
+}
+
+func (o PlanOptions) equal(p PlanOptions) bool {
+	if (o.Platform == nil) != (p.Platform == nil) {
+		return false
+	}
+	if o.Platform != nil && !reflect.DeepEqual(*o.Platform, *p.Platform) {
+		return false
+	}
+	return o.Format == p.Format && o.NoPlatformCheck == p.NoPlatformCheck
+}
+
+// planOptions returns the options of r that a PlanFile records.
+func (r Rebaser) planOptions() PlanOptions {
+	o := PlanOptions{Format: r.format, NoPlatformCheck: r.anyPlatform}
+	if r.platform != nil {
+		p := *r.platform
+		o.Platform = &p
+	}
+	return o
+}
+
+// PinnedImage is a reference and the digest it resolved to.
+type PinnedImage struct {
+	Ref    string  `json:"ref"`
+	Digest v1.Hash `json:"digest"`
+}
+
+// File returns the PlanFile that records p.
+func (p *Plan) File() *PlanFile {
+	return &PlanFile{
+		Original:     PinnedImage{Ref: p.OriginalRef, Digest: p.Original},
+		OldBase:      PinnedImage{Ref: p.OldBaseRef, Digest: p.OldBase},
+		NewBase:      PinnedImage{Ref: p.NewBaseRef, Digest: p.NewBase},
+		Destinations: append([]string(nil), p.References...),
+		Digest:       p.Digest,
+		Options:      p.Options,
+	}
+}
+
+// WritePlan writes the PlanFile of p to w as indented JSON.
+func WritePlan(w io.Writer, p *Plan) error {
+	b, err := json.MarshalIndent(p.File(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// ReadPlan reads a PlanFile written by WritePlan from r.
+func ReadPlan(r io.Reader) (*PlanFile, error) {
+	var pf PlanFile
+	if err := json.NewDecoder(r).Decode(&pf); err != nil {
+		return nil, fmt.Errorf("could not parse plan: %w", err)
+	}
+	for _, p := range []PinnedImage{pf.Original, pf.OldBase, pf.NewBase} {
+		if p.Ref == "" || p.Digest == (v1.Hash{}) {
+			return nil, errors.New("plan does not pin the original and both bases")
+		}
+	}
+	if pf.Digest == (v1.Hash{}) {
+		return nil, errors.New("plan does not record the digest of the rebased image")
+	}
+	if len(pf.Destinations) == 0 {
+		return nil, errNoDestination
+	}
+	return &pf, nil
+}
+
+// Apply performs the rebase recorded in pf. It resolves the inputs again and
+// returns a *DriftError, without pushing anything, if any of them or the
+// rebased image no longer has the digest pf expects. It returns an
+// *OptionsChangedError, without resolving anything, if r does not have the
+// options pf was planned with.
+func (r Rebaser) Apply(ctx context.Context, pf *PlanFile) (*Result, error) {
+	if o := r.planOptions(); !o.equal(pf.Options) {
+		return nil, &OptionsChangedError{Plan: pf.Options, Rebaser: o}
+	}
+	dsts, err := r.parseDestinations(pf.Destinations)
+	if err != nil {
+		return nil, err
+	}
+
+	t := r.roundTripper(ctx)
+	defer t.close()
+	in, err := r.resolve(ctx, t, pf.Original.Ref, pf.OldBase.Ref, pf.NewBase.Ref)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range []struct {
+		image  string
+		pinned PinnedImage
+		img    v1.Image
+	}{
+		{"original", pf.Original, in.orig},
+		{"old base", pf.OldBase, in.oldBase},
+		{"new base", pf.NewBase, in.newBase},
+	} {
+		h, err := c.img.Digest()
+		if err != nil {
+			return nil, &RegistryError{Op: "get " + c.image + " image", Ref: c.pinned.Ref, Err: t.withStatus(err)}
+		}
+		if h != c.pinned.Digest {
+			r.logger.Warn("image drifted since plan", "ref", c.pinned.Ref, "want", c.pinned.Digest.String(), "got", h.String())
+			return nil, &DriftError{Image: c.image, Ref: c.pinned.Ref, Want: c.pinned.Digest, Got: h}
+		}
+	}
+
+	rebased, res, err := r.build(ctx, t, in)
+	if err != nil {
+		return nil, err
+	}
+	if res.Digest != pf.Digest {
+		r.logger.Warn("rebased image differs from plan", "want", pf.Digest.String(), "got", res.Digest.String())
+		return nil, &DriftError{Image: "rebased image", Ref: pf.Original.Ref, Want: pf.Digest, Got: res.Digest}
+	}
+	return r.publish(ctx, t, rebased, res, dsts)
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPlanFileRoundTrip(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	r := New(nil, nil, WithFormat(OCIFormat))
+	p, err := r.Plan(context.Background(), reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("Plan() = %v", err)
+	}
+	var b bytes.Buffer
+	if err := WritePlan(&b, p); err != nil {
+		t.Fatalf("WritePlan() = %v", err)
+	}
+	if !strings.Contains(b.String(), `"format": "oci"`) {
+		t.Errorf("plan does not record the format:\n%s", b.String())
+	}
+	pf, err := ReadPlan(&b)
+	if err != nil {
+		t.Fatalf("ReadPlan() = %v", err)
+	}
+	if pf.Options.Format != OCIFormat {
+		t.Errorf("Options.Format = %v, want %v", pf.Options.Format, OCIFormat)
+	}
+
+	res, err := r.Apply(context.Background(), pf)
+	if err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+	if res.Digest != p.Digest {
+		t.Errorf("Apply() pushed %s, want %s", res.Digest, p.Digest)
+	}
+	if !reg.has("out", "1") {
+		t.Error("out:1 was not pushed")
+	}
+}
+
+func TestApplyOptionsChanged(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	p, err := New(nil, nil, WithFormat(OCIFormat)).Plan(context.Background(), reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("Plan() = %v", err)
+	}
+	reg.requests = nil
+
+	_, err = New(nil, nil).Apply(context.Background(), p.File())
+	var oerr *OptionsChangedError
+	if !errors.As(err, &oerr) || !errors.Is(err, ErrOptionsChanged) {
+		t.Fatalf("Apply() = %v, want an *OptionsChangedError", err)
+	}
+	if errors.Is(err, ErrDrift) {
+		t.Errorf("Apply() = %v, which also matches ErrDrift", err)
+	}
+	if oerr.Plan.Format != OCIFormat || oerr.Rebaser.Format != PreserveFormat {
+		t.Errorf("OptionsChangedError = %+v", oerr)
+	}
+	if len(reg.requests) != 0 {
+		t.Errorf("Apply() made requests %v", reg.requests)
+	}
+}
+
+func TestApplyDrift(t *testing.T) {
+	reg := newTestRegistry(t)
+	_, _, newBase := reg.pushTestImages(t)
+	r := New(nil, nil)
+	p, err := r.Plan(context.Background(), reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("Plan() = %v", err)
+	}
+	_, _, other := testImages(t)
+	reg.push(t, "new:1", other)
+
+	_, err = r.Apply(context.Background(), p.File())
+	var derr *DriftError
+	if !errors.As(err, &derr) {
+		t.Fatalf("Apply() = %v, want a *DriftError", err)
+	}
+	if derr.Image != "new base" || derr.Want != mustDigest(t, newBase) || derr.Got != mustDigest(t, other) {
+		t.Errorf("DriftError = %+v", derr)
+	}
+	if reg.has("out", "1") {
+		t.Error("out:1 was pushed despite the drift")
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// defaultPlatform is the platform of an index entry that does not give one,
+// and the one chosen from indexes unless WithPlatform selects another.
+var defaultPlatform = v1.Platform{OS: "linux", Architecture: "amd64"}
+
+// descPlatform returns the platform of an index entry.
+func descPlatform(desc v1.Descriptor) v1.Platform {
+	if desc.Platform == nil {
+		return defaultPlatform
+	}
+	return *desc.Platform
+}
+
+// platformString formats p as os/architecture[/variant][:os.version].
+func platformString(p v1.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	if p.OSVersion != "" {
+		s += ":" + p.OSVersion
+	}
+	return s
+}
+
+// platformMatches reports whether got is the platform want selects. The
+// variant and os.version are only compared if want gives them.
+func platformMatches(want, got v1.Platform) bool {
+	return want.OS == got.OS && want.Architecture == got.Architecture &&
+		(want.Variant == "" || want.Variant == got.Variant) &&
+		(want.OSVersion == "" || want.OSVersion == got.OSVersion)
+}
+
+// configPlatform returns the platform recorded in the config of img. The
+// vendored v1.ConfigFile has no variant, and reads os.version from the
+// wrong key, so the raw config is parsed instead.
+func configPlatform(img v1.Image) (v1.Platform, error) {
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		return v1.Platform{}, err
+	}
+	var cfg struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+		OSVersion    string `json:"os.version"`
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return v1.Platform{}, err
+	}
+	return v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant, OSVersion: cfg.OSVersion}, nil
+}
+
+// matchPlatform returns the entry of index, read from s, for the Rebaser's
+// platform, or for linux/amd64 if none was selected.
+func (r Rebaser) matchPlatform(s string, index *v1.IndexManifest) (*v1.Descriptor, error) {
+	want := defaultPlatform
+	if r.platform != nil {
+		want = *r.platform
+	}
+	for _, desc := range index.Manifests {
+		if platformMatches(want, descPlatform(desc)) {
+			return &desc, nil
+		}
+	}
+	return nil, notFound(s, index, want)
+}
+
+// findPlatform returns the entry of index, read from s, with the same os,
+// architecture and variant as p, and the same os.version if p gives one.
+// Attestation manifests are skipped.
+func findPlatform(s string, index *v1.IndexManifest, p v1.Platform) (*v1.Descriptor, error) {
+	for _, desc := range index.Manifests {
+		if isAttestation(desc) {
+			continue
+		}
+		q := descPlatform(desc)
+		if q.OS == p.OS && q.Architecture == p.Architecture && q.Variant == p.Variant &&
+			(p.OSVersion == "" || q.OSVersion == p.OSVersion) {
+			return &desc, nil
+		}
+	}
+	return nil, notFound(s, index, p)
+}
+
+// notFound returns a *PlatformNotFoundError for p in index, read from s.
+func notFound(s string, index *v1.IndexManifest, p v1.Platform) error {
+	err := &PlatformNotFoundError{Ref: s, Platform: p}
+	for _, desc := range index.Manifests {
+		if !isAttestation(desc) {
+			err.Available = append(err.Available, descPlatform(desc))
+		}
+	}
+	return err
+}
+
+// Annotations by which buildx marks the attestation manifest of an image in
+// an index, and gives the digest of the image it attests to.
+const (
+	referenceTypeAnnotation   = "vnd.docker.reference.type"
+	referenceDigestAnnotation = "vnd.docker.reference.digest"
+)
+
+// isAttestation reports whether desc is an attestation manifest, such as the
+// provenance and SBOMs that buildx adds to an index. These are not images of
+// a platform, and are listed as unknown/unknown.
+func isAttestation(desc v1.Descriptor) bool {
+	return desc.Annotations[referenceTypeAnnotation] == "attestation-manifest"
+}
+
+// checkPlatform returns a *PlatformNotFoundError if a platform was selected
+// with WithPlatform and img, read from s, is for another. An image whose
+// config does not record its platform is accepted.
+func (r Rebaser) checkPlatform(s string, img v1.Image) error {
+	if r.platform == nil {
+		return nil
+	}
+	p, err := configPlatform(img)
+	if err != nil {
+		return err
+	}
+	if p.OS == "" && p.Architecture == "" {
+		r.logger.Debug("image does not record its platform", "ref", s)
+		return nil
+	}
+	if !platformMatches(*r.platform, p) {
+		return &PlatformNotFoundError{Ref: s, Platform: *r.platform, Available: []v1.Platform{p}}
+	}
+	return nil
+}
+
+// checkPlatformMatch returns a *PlatformMismatchError unless the configs of
+// orig and newBase record the same os and architecture, and the same variant
+// and os.version where both give one. An image whose config does not record
+// its platform matches any other.
+func checkPlatformMatch(orig, newBase v1.Image) error {
+	op, err := configPlatform(orig)
+	if err != nil {
+		return fmt.Errorf("could not get platform of original: %w", err)
+	}
+	np, err := configPlatform(newBase)
+	if err != nil {
+		return fmt.Errorf("could not get platform of new base: %w", err)
+	}
+	if (op.OS == "" && op.Architecture == "") || (np.OS == "" && np.Architecture == "") {
+		return nil
+	}
+	both := func(a, b string) bool {
+		return a == "" || b == "" || a == b
+	}
+	if op.OS != np.OS || op.Architecture != np.Architecture || !both(op.Variant, np.Variant) || !both(op.OSVersion, np.OSVersion) {
+		return &PlatformMismatchError{OriginalPlatform: op, NewBasePlatform: np}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// configPlatformImage is an image whose config has been rewritten. The
+// vendored v1.ConfigFile cannot record a variant, so mutate.ConfigFile is of
+// no use here.
+type configPlatformImage struct {
+	base     v1.Image
+	manifest []byte
+	config   []byte
+}
+
+// MediaType implements partial.CompressedImageCore
+func (i *configPlatformImage) MediaType() (types.MediaType, error) {
+	return i.base.MediaType()
+}
+
+// LayerByDigest implements partial.CompressedImageCore
+func (i *configPlatformImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	return i.base.LayerByDigest(h)
+}
+
+// RawManifest implements partial.CompressedImageCore
+func (i *configPlatformImage) RawManifest() ([]byte, error) {
+	return i.manifest, nil
+}
+
+// RawConfigFile implements partial.CompressedImageCore
+func (i *configPlatformImage) RawConfigFile() ([]byte, error) {
+	return i.config, nil
+}
+
+// withConfigPlatform returns img with p recorded in its config.
+func withConfigPlatform(t *testing.T, img v1.Image, p v1.Platform) v1.Image {
+	t.Helper()
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg["os"], cfg["architecture"], cfg["variant"], cfg["os.version"] = p.OS, p.Architecture, p.Variant, p.OSVersion
+	ci := &configPlatformImage{base: img}
+	if ci.config, err = json.Marshal(cfg); err != nil {
+		t.Fatal(err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Config.Size = int64(len(ci.config))
+	if m.Config.Digest, err = v1.NewHash(digestOf(ci.config)); err != nil {
+		t.Fatal(err)
+	}
+	if ci.manifest, err = json.Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+	img, err = partial.CompressedToImage(ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestCheckPlatformMatch(t *testing.T) {
+	orig, _, newBase := testImages(t)
+	for _, tc := range []struct {
+		desc          string
+		orig, newBase v1.Platform
+		mismatch      bool
+	}{
+		{desc: "same", orig: amd64, newBase: amd64},
+		{desc: "architecture", orig: amd64, newBase: arm64, mismatch: true},
+		{desc: "os", orig: amd64, newBase: v1.Platform{OS: "windows", Architecture: "amd64"}, mismatch: true},
+		{desc: "variant on one side", orig: v1.Platform{OS: "linux", Architecture: "arm64"}, newBase: arm64},
+		{desc: "variant", orig: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, newBase: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, mismatch: true},
+		{desc: "os.version", orig: v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"}, newBase: v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.1"}, mismatch: true},
+		{desc: "unrecorded", newBase: arm64},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := checkPlatformMatch(withConfigPlatform(t, orig, tc.orig), withConfigPlatform(t, newBase, tc.newBase))
+			if got := errors.Is(err, ErrPlatformMismatch); got != tc.mismatch {
+				t.Errorf("checkPlatformMatch() = %v, want mismatch %t", err, tc.mismatch)
+			}
+		})
+	}
+}
+
+func TestRebasePlatformMismatch(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, oldBase, newBase := testImages(t)
+	reg.push(t, "app:1", withConfigPlatform(t, orig, amd64))
+	reg.push(t, "old:1", oldBase)
+	reg.push(t, "new:1", withConfigPlatform(t, newBase, arm64))
+
+	_, err := New(nil, nil).Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	var perr *PlatformMismatchError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Rebase() = %v, want a *PlatformMismatchError", err)
+	}
+	if platformString(perr.OriginalPlatform) != platformString(amd64) || platformString(perr.NewBasePlatform) != platformString(arm64) {
+		t.Errorf("platforms = %s, %s, want %s, %s", platformString(perr.OriginalPlatform), platformString(perr.NewBasePlatform), platformString(amd64), platformString(arm64))
+	}
+	if reg.has("out", "1") {
+		t.Error("out:1 was pushed despite the mismatch")
+	}
+}
+
+func TestRebaseWithoutPlatformCheck(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, oldBase, newBase := testImages(t)
+	orig = withConfigPlatform(t, orig, amd64)
+	newBase = withConfigPlatform(t, newBase, arm64)
+	reg.push(t, "app:1", orig)
+	reg.push(t, "old:1", oldBase)
+	reg.push(t, "new:1", newBase)
+
+	res, err := New(nil, nil, WithoutPlatformCheck()).Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	checkRebasedOnto(t, res, orig, newBase)
+	if !reg.has("out", "1") {
+		t.Error("out:1 was not pushed")
+	}
+}
+
+func TestRebaseKeepsPlatform(t *testing.T) {
+	orig, oldBase, newBase := testImages(t)
+	orig = withConfigPlatform(t, orig, arm64)
+	newBase = withConfigPlatform(t, newBase, arm64)
+	rebased, err := Image(orig, oldBase, newBase)
+	if err != nil {
+		t.Fatalf("Image() = %v", err)
+	}
+	p, err := configPlatform(rebased)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if platformString(p) != platformString(arm64) {
+		t.Errorf("rebased image is for %s, want %s", platformString(p), platformString(arm64))
+	}
+
+	// Rebasing the result onto a base for another platform must still fail.
+	_, _, other := testImages(t)
+	if _, err := Image(rebased, newBase, withConfigPlatform(t, other, amd64)); !errors.Is(err, ErrPlatformMismatch) {
+		t.Errorf("second Image() = %v, want %v", err, ErrPlatformMismatch)
+	}
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ProgressKind identifies what a ProgressEvent reports.
+type ProgressKind int
+
+// The kinds of progress reported while pushing.
+const (
+	// BlobChecking is reported before asking whether the destination
+	// already holds a blob.
+	BlobChecking ProgressKind = iota
+	// BlobSkipped is reported when the destination already holds a blob.
+	BlobSkipped
+	// BlobMounting is reported before attempting to mount a blob from the
+	// repository it was read from.
+	BlobMounting
+	// BlobUploading is reported as the bytes of a blob are sent.
+	BlobUploading
+	// BlobCommitted is reported once a blob has been mounted or uploaded.
+	BlobCommitted
+	// ManifestPushing is reported before a manifest is put.
+	ManifestPushing
+	// ManifestCommitted is reported once a manifest has been put.
+	ManifestCommitted
+)
+
+var progressKindNames = map[ProgressKind]string{
+	BlobChecking:      "checking",
+	BlobSkipped:       "skipped",
+	BlobMounting:      "mounting",
+	BlobUploading:     "uploading",
+	BlobCommitted:     "committed",
+	ManifestPushing:   "pushing manifest",
+	ManifestCommitted: "committed manifest",
+}
+
+func (k ProgressKind) String() string {
+	return progressKindNames[k]
+}
+
+// ProgressEvent reports the progress of a push.
+type ProgressEvent struct {
+	Kind ProgressKind
+	// Ref is the destination being pushed to.
+	Ref string
+	// Digest identifies the blob or manifest the event is about.
+	Digest v1.Hash
+	// Complete is the number of bytes of the blob sent so far and Total its
+	// size. They are only set for BlobUploading.
+	Complete int64
+	Total    int64
+}
+
+// WithProgress reports the progress of every push to f. Calls to f are
+// serialized, even though blobs are uploaded concurrently.
+func WithProgress(f func(ProgressEvent)) Option {
+	return func(r *Rebaser) {
+		r.progress = f
+	}
+}
+
+// progress serializes events for a single destination.
+type progress struct {
+	ref string
+	f   func(ProgressEvent)
+
+	mu sync.Mutex
+}
+
+func (r Rebaser) newProgress(ref string) *progress {
+	if r.progress == nil {
+		return nil
+	}
+	return &progress{ref: ref, f: r.progress}
+}
+
+func (p *progress) report(e ProgressEvent) {
+	if p == nil {
+		return
+	}
+	e.Ref = p.ref
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.f(e)
+}
+
+// transport observes the requests a push makes to report blob and
+// manifest events. manifest is the digest of the image or index being
+// pushed, which a manifest put by tag is reported for.
+func (p *progress) transport(inner http.RoundTripper, manifest v1.Hash) http.RoundTripper {
+	if p == nil {
+		return inner
+	}
+	return &progressTransport{inner: inner, p: p, manifest: manifest}
+}
+
+// image wraps the layers of img so that reading them reports BlobUploading.
+func (p *progress) image(img v1.Image) v1.Image {
+	if p == nil {
+		return img
+	}
+	return &progressImage{Image: img, p: p}
+}
+
+// index wraps the images of idx like image.
+func (p *progress) index(idx v1.ImageIndex) v1.ImageIndex {
+	if p == nil {
+		return idx
+	}
+	return &progressIndex{base: idx, p: p}
+}
+
+type progressTransport struct {
+	inner    http.RoundTripper
+	p        *progress
+	manifest v1.Hash
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *progressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var before, after ProgressEvent
+	var okStatus int
+	path := req.URL.Path
+	switch {
+	case strings.Contains(path, "/manifests/") && req.Method == http.MethodPut:
+		// The images of an index are put by digest before the index.
+		h, err := v1.NewHash(path[strings.LastIndex(path, "/")+1:])
+		if err != nil {
+			h = t.manifest
+		}
+		before = ProgressEvent{Kind: ManifestPushing, Digest: h}
+		after = ProgressEvent{Kind: ManifestCommitted, Digest: h}
+	case strings.Contains(path, "/blobs/uploads/"):
+		q := req.URL.Query()
+		switch {
+		case req.Method == http.MethodPost && q.Get("mount") != "" && q.Get("from") != "":
+			h, err := v1.NewHash(q.Get("mount"))
+			if err != nil {
+				break
+			}
+			before = ProgressEvent{Kind: BlobMounting, Digest: h}
+			after, okStatus = ProgressEvent{Kind: BlobCommitted, Digest: h}, http.StatusCreated
+		case req.Method == http.MethodPut && q.Get("digest") != "":
+			h, err := v1.NewHash(q.Get("digest"))
+			if err != nil {
+				break
+			}
+			after, okStatus = ProgressEvent{Kind: BlobCommitted, Digest: h}, http.StatusCreated
+		}
+	case strings.Contains(path, "/blobs/") && req.Method == http.MethodHead:
+		h, err := v1.NewHash(path[strings.LastIndex(path, "/")+1:])
+		if err != nil {
+			break
+		}
+		before = ProgressEvent{Kind: BlobChecking, Digest: h}
+		after, okStatus = ProgressEvent{Kind: BlobSkipped, Digest: h}, http.StatusOK
+	}
+
+	if before.Digest != (v1.Hash{}) {
+		t.p.report(before)
+	}
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || after.Digest == (v1.Hash{}) {
+		return resp, err
+	}
+	if (okStatus == 0 && resp.StatusCode/100 == 2) || resp.StatusCode == okStatus {
+		t.p.report(after)
+	}
+	return resp, nil
+}
+
+type progressIndex struct {
+	base v1.ImageIndex
+	p    *progress
+}
+
+// MediaType implements v1.ImageIndex
+func (i *progressIndex) MediaType() (types.MediaType, error) {
+	return i.base.MediaType()
+}
+
+// Digest implements v1.ImageIndex
+func (i *progressIndex) Digest() (v1.Hash, error) {
+	return i.base.Digest()
+}
+
+// IndexManifest implements v1.ImageIndex
+func (i *progressIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.base.IndexManifest()
+}
+
+// RawManifest implements v1.ImageIndex
+func (i *progressIndex) RawManifest() ([]byte, error) {
+	return i.base.RawManifest()
+}
+
+// Image implements v1.ImageIndex
+func (i *progressIndex) Image(h v1.Hash) (v1.Image, error) {
+	img, err := i.base.Image(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.p.image(img), nil
+}
+
+// ImageIndex implements v1.ImageIndex
+func (i *progressIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	idx, err := i.base.ImageIndex(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.p.index(idx), nil
+}
+
+type progressImage struct {
+	v1.Image
+	p *progress
+}
+
+// Layers implements v1.Image
+func (i *progressImage) Layers() ([]v1.Layer, error) {
+	ls, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for n, l := range ls {
+		ls[n] = i.wrap(l)
+	}
+	return ls, nil
+}
+
+// LayerByDigest implements v1.Image
+func (i *progressImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.wrap(l), nil
+}
+
+// LayerByDiffID implements v1.Image
+func (i *progressImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDiffID(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.wrap(l), nil
+}
+
+// wrap keeps the remote.MountableLayer hint outermost, since remote.Write
+// looks for it to attempt cross-repository mounts.
+func (i *progressImage) wrap(l v1.Layer) v1.Layer {
+	if ml, ok := l.(*remote.MountableLayer); ok {
+		return &remote.MountableLayer{
+			Layer:     &progressLayer{Layer: ml.Layer, p: i.p},
+			Reference: ml.Reference,
+		}
+	}
+	return &progressLayer{Layer: l, p: i.p}
+}
+
+type progressLayer struct {
+	v1.Layer
+	p *progress
+}
+
+// Compressed implements v1.Layer
+func (l *progressLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	h, err := l.Digest()
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	size, err := l.Size()
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &progressReader{ReadCloser: rc, p: l.p, digest: h, total: size}, nil
+}
+
+type progressReader struct {
+	io.ReadCloser
+	p        *progress
+	digest   v1.Hash
+	complete int64
+	total    int64
+}
+
+// Read implements io.Reader
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		r.complete += int64(n)
+		r.p.report(ProgressEvent{Kind: BlobUploading, Digest: r.digest, Complete: r.complete, Total: r.total})
+	}
+	return n, err
+}
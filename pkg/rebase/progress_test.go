@@ -0,0 +1,136 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// progressRecorder records the events reported to it.
+type progressRecorder struct {
+	events []ProgressEvent
+}
+
+func (p *progressRecorder) record(e ProgressEvent) {
+	p.events = append(p.events, e)
+}
+
+// kinds returns how many events of each kind were reported.
+func (p *progressRecorder) kinds() map[ProgressKind]int {
+	n := map[ProgressKind]int{}
+	for _, e := range p.events {
+		n[e.Kind]++
+	}
+	return n
+}
+
+// committed returns the digests of the manifests reported committed, in
+// order.
+func (p *progressRecorder) committed() []v1.Hash {
+	var hs []v1.Hash
+	for _, e := range p.events {
+		if e.Kind == ManifestCommitted {
+			hs = append(hs, e.Digest)
+		}
+	}
+	return hs
+}
+
+func TestProgress(t *testing.T) {
+	reg := newTestRegistry(t)
+	_, _, newBase := reg.pushTestImages(t)
+	// The destination, in another registry, already has the new base.
+	dst := newTestRegistry(t)
+	dst.push(t, "base:1", newBase)
+
+	var p progressRecorder
+	r := New(nil, nil, WithProgress(p.record))
+	res, err := r.Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", dst.host+"/out:1")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+
+	// The config and every layer are checked, the new base layers are
+	// skipped, and the config and the top layer are uploaded.
+	want := map[ProgressKind]int{BlobChecking: 5, BlobSkipped: 3, BlobCommitted: 2, ManifestPushing: 1, ManifestCommitted: 1}
+	kinds := p.kinds()
+	for k, n := range want {
+		if kinds[k] != n {
+			t.Errorf("%d %s events, want %d", kinds[k], k, n)
+		}
+	}
+	if kinds[BlobUploading] == 0 {
+		t.Error("no upload progress reported")
+	}
+	if got := p.committed(); len(got) != 1 || got[0] != res.Digest {
+		t.Errorf("committed manifests %v, want %s", got, res.Digest)
+	}
+	for _, e := range p.events {
+		if e.Ref != res.Reference {
+			t.Fatalf("event %+v is for %s, want %s", e, e.Ref, res.Reference)
+		}
+		if e.Kind == BlobUploading && (e.Complete <= 0 || e.Complete > e.Total) {
+			t.Errorf("upload of %s reported %d of %d bytes", e.Digest, e.Complete, e.Total)
+		}
+	}
+}
+
+func TestProgressIndex(t *testing.T) {
+	reg := newTestRegistry(t)
+	origA, oldA, newA := platformImages(t, amd64)
+	origB, oldB, newB := platformImages(t, arm64)
+	reg.pushIndex(t, "app", "1", indexEntry{platform: amd64, img: origA}, indexEntry{platform: arm64, img: origB})
+	reg.pushIndex(t, "old", "1", indexEntry{platform: amd64, img: oldA}, indexEntry{platform: arm64, img: oldB})
+	reg.pushIndex(t, "new", "1", indexEntry{platform: amd64, img: newA}, indexEntry{platform: arm64, img: newB})
+	dst := newTestRegistry(t)
+
+	var p progressRecorder
+	r := New(nil, nil, WithProgress(p.record))
+	res, err := r.RebaseIndex(context.Background(), reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", dst.host+"/out:1")
+	if err != nil {
+		t.Fatalf("RebaseIndex() = %v", err)
+	}
+
+	// Each image is committed by its own digest, and then the index.
+	want := []v1.Hash{res.Platforms[0].Result.Digest, res.Platforms[1].Result.Digest, res.Digest}
+	got := p.committed()
+	if len(got) != len(want) {
+		t.Fatalf("committed manifests %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("committed manifest %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+	kinds := p.kinds()
+	if kinds[ManifestPushing] != len(want) {
+		t.Errorf("%d manifests pushed, want %d", kinds[ManifestPushing], len(want))
+	}
+	for _, k := range []ProgressKind{BlobChecking, BlobUploading, BlobCommitted} {
+		if kinds[k] == 0 {
+			t.Errorf("no %s events reported for the images of the index", k)
+		}
+	}
+	for _, e := range p.events {
+		if e.Ref != res.Reference {
+			t.Fatalf("event %+v is for %s, want %s", e, e.Ref, res.Reference)
+		}
+	}
+}
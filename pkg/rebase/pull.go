@@ -0,0 +1,341 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/v1util"
+)
+
+// manifestTypes are the media types accepted for the manifest of an image.
+var manifestTypes = []types.MediaType{
+	types.DockerManifestSchema2,
+	types.OCIManifestSchema1,
+	types.DockerManifestSchema1Signed,
+	types.DockerManifestSchema1,
+}
+
+// pullClient returns an HTTP client authorized to pull from the repository
+// of ref.
+func (r Rebaser) pullClient(t http.RoundTripper, ref name.Reference) (*http.Client, error) {
+	a, err := r.keychain.Resolve(ref.Context().Registry)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	tr, err := transport.New(ref.Context().Registry, a, t, []string{ref.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// fetchImage returns the image at ref, which may also be an index, in which
+// case the image for the Rebaser's platform is chosen from it, or the one
+// for linux/amd64 if none was selected.
+//
+// The vendored remote package cannot read a signed schema 1 manifest by
+// digest, since it compares the digest with that of the whole manifest
+// rather than that of its payload, so manifests are fetched here instead.
+// Indexes are read here too, so that every registry read goes the same way.
+func (r Rebaser) fetchImage(client *http.Client, ref name.Reference) (v1.Image, error) {
+	accept := append([]types.MediaType{types.DockerManifestList, types.OCIImageIndex}, manifestTypes...)
+	raw, mt, h, err := fetchManifest(client, ref, accept)
+	if err != nil {
+		return nil, err
+	}
+	if mt == types.OCIImageIndex || mt == types.DockerManifestList {
+		index, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		desc, err := r.matchPlatform(ref.String(), index)
+		if err != nil {
+			return nil, err
+		}
+		return r.fetchChild(client, ref.Context(), desc.Digest)
+	}
+	return r.newRegistryImage(client, ref, raw, mt, h)
+}
+
+// fetchChild returns the image h in repo, listed by an index.
+func (r Rebaser) fetchChild(client *http.Client, repo name.Repository, h v1.Hash) (v1.Image, error) {
+	ref, err := name.NewDigest(fmt.Sprintf("%s@%s", repo, h), name.StrictValidation)
+	if err != nil {
+		return nil, err
+	}
+	raw, mt, h, err := fetchManifest(client, ref, manifestTypes)
+	if err != nil {
+		return nil, err
+	}
+	return r.newRegistryImage(client, ref, raw, mt, h)
+}
+
+// newRegistryImage returns the image at ref whose manifest raw, of media
+// type mt and digest h, has been fetched.
+func (r Rebaser) newRegistryImage(client *http.Client, ref name.Reference, raw []byte, mt types.MediaType, h v1.Hash) (v1.Image, error) {
+	img, err := partial.CompressedToImage(&registryImage{client: client, repo: ref.Context(), raw: raw, mediaType: mt})
+	if err != nil {
+		return nil, err
+	}
+	if isSchema1(raw, mt) {
+		r.logger.Info("converting schema 1 manifest", "ref", ref.String())
+		return fromSchema1(img, ref, h)
+	}
+	return &mountableImage{Image: img, ref: ref}, nil
+}
+
+// fetchIndex returns the image index at ref.
+func (r Rebaser) fetchIndex(client *http.Client, ref name.Reference) (v1.ImageIndex, error) {
+	raw, mt, _, err := fetchManifest(client, ref, []types.MediaType{types.DockerManifestList, types.OCIImageIndex})
+	if err != nil {
+		return nil, err
+	}
+	if mt != types.OCIImageIndex && mt != types.DockerManifestList {
+		return nil, fmt.Errorf("%s is not an image index", mt)
+	}
+	m, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return &registryIndex{r: r, client: client, repo: ref.Context(), raw: raw, mediaType: mt, manifest: m}, nil
+}
+
+// registryIndex is an image index in repo whose manifest has already been
+// fetched. Its images are fetched as they are asked for.
+type registryIndex struct {
+	r         Rebaser
+	client    *http.Client
+	repo      name.Repository
+	raw       []byte
+	mediaType types.MediaType
+	manifest  *v1.IndexManifest
+}
+
+var _ v1.ImageIndex = (*registryIndex)(nil)
+
+// MediaType implements v1.ImageIndex
+func (i *registryIndex) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+// Digest implements v1.ImageIndex
+func (i *registryIndex) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+// IndexManifest implements v1.ImageIndex
+func (i *registryIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest implements v1.ImageIndex
+func (i *registryIndex) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+// Image implements v1.ImageIndex
+func (i *registryIndex) Image(h v1.Hash) (v1.Image, error) {
+	return i.r.fetchChild(i.client, i.repo, h)
+}
+
+// ImageIndex implements v1.ImageIndex
+func (i *registryIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	ref, err := name.NewDigest(fmt.Sprintf("%s@%s", i.repo, h), name.StrictValidation)
+	if err != nil {
+		return nil, err
+	}
+	return i.r.fetchIndex(i.client, ref)
+}
+
+// fetchManifest returns the manifest at ref, of one of the media types in
+// accept, along with its media type and digest. If ref is a digest, it must
+// match the digest of the manifest.
+func fetchManifest(client *http.Client, ref name.Reference, accept []types.MediaType) ([]byte, types.MediaType, v1.Hash, error) {
+	repo := ref.Context()
+	u := url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/manifests/%s", repo.RepositoryStr(), ref.Identifier()),
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", v1.Hash{}, err
+	}
+	var mts []string
+	for _, mt := range accept {
+		mts = append(mts, string(mt))
+	}
+	req.Header.Set("Accept", strings.Join(mts, ","))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", v1.Hash{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, "", v1.Hash{}, err
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", v1.Hash{}, err
+	}
+	mt := types.MediaType(resp.Header.Get("Content-Type"))
+	h, err := manifestDigest(raw, mt)
+	if err != nil {
+		return nil, "", v1.Hash{}, err
+	}
+	if d, ok := ref.(name.Digest); ok && h.String() != d.DigestStr() {
+		return nil, "", v1.Hash{}, fmt.Errorf("manifest of %s has digest %s", ref, h)
+	}
+	return raw, mt, h, nil
+}
+
+// manifestDigest returns the digest by which a registry serves raw, a
+// manifest of media type mt. That of a signed schema 1 manifest is the
+// digest of its payload.
+func manifestDigest(raw []byte, mt types.MediaType) (v1.Hash, error) {
+	if isSchema1(raw, mt) {
+		var err error
+		if raw, err = schema1Payload(raw); err != nil {
+			return v1.Hash{}, err
+		}
+	}
+	h, _, err := v1.SHA256(bytes.NewReader(raw))
+	return h, err
+}
+
+// registryImage implements partial.CompressedImageCore for an image in repo
+// whose manifest has already been fetched.
+type registryImage struct {
+	client    *http.Client
+	repo      name.Repository
+	raw       []byte
+	mediaType types.MediaType
+
+	mu     sync.Mutex
+	config []byte
+}
+
+// MediaType implements partial.CompressedImageCore
+func (i *registryImage) MediaType() (types.MediaType, error) {
+	if i.mediaType != "" {
+		return i.mediaType, nil
+	}
+	return types.DockerManifestSchema2, nil
+}
+
+// RawManifest implements partial.CompressedImageCore
+func (i *registryImage) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+// RawConfigFile implements partial.CompressedImageCore
+func (i *registryImage) RawConfigFile() ([]byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.config != nil {
+		return i.config, nil
+	}
+	m, err := partial.Manifest(i)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := i.blob(m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if i.config, err = ioutil.ReadAll(rc); err != nil {
+		i.config = nil
+		return nil, err
+	}
+	return i.config, nil
+}
+
+// LayerByDigest implements partial.CompressedImageCore
+func (i *registryImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	return &registryLayer{img: i, digest: h}, nil
+}
+
+// blob returns the contents of the blob h, which are checked against h as
+// they are read.
+func (i *registryImage) blob(h v1.Hash) (io.ReadCloser, error) {
+	u := url.URL{
+		Scheme: i.repo.Registry.Scheme(),
+		Host:   i.repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/blobs/%s", i.repo.RepositoryStr(), h),
+	}
+	resp, err := i.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return v1util.VerifyReadCloser(resp.Body, h)
+}
+
+// registryLayer implements partial.CompressedLayer. Its size and diff ID are
+// read from the manifest and config of its image.
+type registryLayer struct {
+	img    *registryImage
+	digest v1.Hash
+}
+
+// Digest implements partial.CompressedLayer
+func (l *registryLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+// Compressed implements partial.CompressedLayer
+func (l *registryLayer) Compressed() (io.ReadCloser, error) {
+	return l.img.blob(l.digest)
+}
+
+// Size implements partial.CompressedLayer
+func (l *registryLayer) Size() (int64, error) {
+	return partial.BlobSize(l, l.digest)
+}
+
+// Manifest implements partial.WithManifest
+func (l *registryLayer) Manifest() (*v1.Manifest, error) {
+	return partial.Manifest(l.img)
+}
+
+// ConfigFile implements partial.WithConfigFile
+func (l *registryLayer) ConfigFile() (*v1.ConfigFile, error) {
+	return partial.ConfigFile(l.img)
+}
+
+// DiffID implements partial.WithDiffID
+func (l *registryLayer) DiffID() (v1.Hash, error) {
+	return partial.BlobToDiffID(l, l.digest)
+}
@@ -18,104 +18,297 @@ limitations under the License.
 package rebase
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/mutate"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
 // Rebaser provides a method for rebasing Docker images.
 type Rebaser struct {
-	keychain  authn.Keychain
-	transport http.RoundTripper
+	keychain    authn.Keychain
+	transport   http.RoundTripper
+	timeouts    Timeouts
+	platform    *v1.Platform
+	userAgent   string
+	retry       RetryPolicy
+	strictness  name.Strictness
+	logger      Logger
+	progress    func(ProgressEvent)
+	dockerHost  string
+	format      Format
+	mismatch    MismatchPolicy
+	missing     MissingPlatformPolicy
+	anyPlatform bool
+	sources     map[string]ImageSource
+	sinks       map[string]ImageSink
 }
 
-// New returns a new Rebaser, using the specified keychain and HTTP transport.
-func New(k authn.Keychain, t http.RoundTripper) Rebaser {
-	return Rebaser{
-		keychain:  k,
-		transport: t,
+// Interface is the set of rebase operations a Rebaser provides. Code that
+// uses a Rebaser can depend on Interface instead, and substitute the fake in
+// package rebasetest in its tests.
+type Interface interface {
+	Rebase(origStr, oldBaseStr, newBaseStr string, rebased ...string) (*Result, error)
+	RebaseContext(ctx context.Context, origStr, oldBaseStr, newBaseStr string, rebased ...string) (*Result, error)
+	Plan(ctx context.Context, origStr, oldBaseStr, newBaseStr string, rebased ...string) (*Plan, error)
+	Apply(ctx context.Context, pf *PlanFile) (*Result, error)
+	RebaseIndex(ctx context.Context, origStr, oldBaseStr, newBaseStr string, rebased ...string) (*IndexResult, error)
+	RebaseMulti(ctx context.Context, inputs []PlatformInput, rebased ...string) (*IndexResult, error)
+	RebaseArchive(ctx context.Context, src, dst, oldBaseStr, newBaseStr string) (*ArchiveResult, error)
+	ExportBundle(ctx context.Context, w io.Writer, origStr, oldBaseStr, newBaseStr string, rebased ...string) (*Result, error)
+	ImportBundle(ctx context.Context, path string, rebased ...string) (*Result, error)
+}
+
+var _ Interface = Rebaser{}
+
+// New returns a new Rebaser, using the specified keychain and HTTP transport
+// and then applying opts. A nil keychain or transport selects
+// authn.DefaultKeychain or http.DefaultTransport respectively.
+func New(k authn.Keychain, t http.RoundTripper, opts ...Option) Rebaser {
+	r := Rebaser{
+		keychain:   k,
+		transport:  t,
+		strictness: name.WeakValidation,
+	}
+	return r.With(opts...)
+}
+
+// With returns a copy of r with opts applied, leaving r unchanged. This sets
+// options for a single rebase, such as the platform:
+//
+//	r.With(rebase.WithPlatform(p)).Rebase(orig, oldBase, newBase, rebased)
+func (r Rebaser) With(opts ...Option) Rebaser {
+	for _, opt := range opts {
+		opt(&r)
+	}
+	if r.keychain == nil {
+		r.keychain = authn.DefaultKeychain
+	}
+	if r.transport == nil {
+		r.transport = http.DefaultTransport
 	}
+	if r.logger == nil {
+		r.logger = nopLogger{}
+	}
+	return r
 }
 
-func (r Rebaser) get(s string) (v1.Image, error) {
-	ref, err := name.ParseReference(s, name.WeakValidation)
+// get resolves s to an image. s is a registry reference, a "docker save"
+// archive prefixed with "tarball:", an image layout prefixed with "oci:", an
+// image in a Docker Engine prefixed with "docker-daemon:" or a reference for
+// a source registered with WithSource. References without a registered
+// source are read by the DefaultSource for their scheme.
+func (r Rebaser) get(t *contextTransport, s string) (v1.Image, error) {
+	src, ref := r.source(s)
+	if src == nil {
+		src, ref = DefaultSource(""), s
+		for _, scheme := range builtinSchemes {
+			if strings.HasPrefix(s, scheme) {
+				src, ref = DefaultSource(strings.TrimSuffix(scheme, ":")), strings.TrimPrefix(s, scheme)
+			}
+		}
+	}
+	img, err := src.Image(r.sourceContext(t), ref)
+	if err != nil {
+		return nil, err
+	}
+	// Resolve the manifest now, so that failures are attributed to this
+	// image rather than surfacing during a later phase.
+	h, err := img.Digest()
 	if err != nil {
 		return nil, err
 	}
-	return remote.Image(ref, remote.WithAuthFromKeychain(r.keychain), remote.WithTransport(r.transport))
+	if err := r.checkPlatform(s, img); err != nil {
+		return nil, err
+	}
+	r.logger.Debug("resolved image", "ref", s, "digest", h.String())
+	return img, nil
+}
+
+func (r Rebaser) remoteImage(t *contextTransport, s string) (v1.Image, error) {
+	ref, err := name.ParseReference(s, r.strictness)
+	if err != nil {
+		return nil, err
+	}
+	client, err := r.pullClient(t, ref)
+	if err != nil {
+		return nil, err
+	}
+	return r.fetchImage(client, ref)
 }
 
 // Rebase constructs and pushes a new image based on orig, with layers from
 // oldBase removed and replaced with those in newBase. The new image is pushed
-// to the reference described by rebased.
-func (r Rebaser) Rebase(origStr, oldBaseStr, newBaseStr, rebasedStr string) error {
-	orig, err := r.get(origStr)
+// to each reference in rebased; the returned Result describes what was
+// pushed.
+//
+// Any of orig, oldBase and newBase may name a "docker save" archive instead
+// of a registry image, as tarball:<path>[:<tag>]. The tag selects an image
+// from an archive that holds several. They may also name an image in an OCI
+// image layout, as oci:<dir>[:<ref name>] or oci:<dir>@<digest>, or an image
+// in a Docker Engine, as docker-daemon:<reference>.
+//
+// A reference in rebased may be a tag, a digest, or a bare repository, which
+// is pushed to by digest. Blobs are uploaded once per repository, and any
+// further tags in the same repository receive only the manifest. A reference
+// of the form tarball:<path>:<tag> writes a "docker save" archive that can be
+// loaded with "docker load" instead; a path of "-" writes it to stdout. A
+// reference of the form oci:<dir>[:<ref name>] adds the image to an OCI image
+// layout, creating it if necessary, and one of the form docker-daemon:<tag>
+// loads it into a Docker Engine.
+//
+// References with a scheme registered with WithSource or WithSink are read
+// or written by the registered source or sink instead.
+//
+// The rebased image keeps the manifest format of the original, Docker or
+// OCI, unless WithFormat selects one. An original in a registry may also have
+// a schema 1 manifest, in which case the rebased image is a Docker schema 2
+// image unless WithFormat selects OCI.
+//
+// The rebase fails with a *PlatformMismatchError if the configs of orig and
+// newBase record different platforms, unless WithoutPlatformCheck is given.
+func (r Rebaser) Rebase(origStr, oldBaseStr, newBaseStr string, rebased ...string) (*Result, error) {
+	return r.RebaseContext(context.Background(), origStr, oldBaseStr, newBaseStr, rebased...)
+}
+
+// RebaseContext is like Rebase, but every registry request it makes is bound
+// to ctx. Phases are further bounded by the Rebaser's Timeouts, if any.
+func (r Rebaser) RebaseContext(ctx context.Context, origStr, oldBaseStr, newBaseStr string, rebasedStrs ...string) (*Result, error) {
+	dsts, err := r.parseDestinations(rebasedStrs)
 	if err != nil {
-		return fmt.Errorf("could not get original image %q: %v", origStr, err)
+		return nil, err
 	}
-	origConfig, err := orig.ConfigFile()
+
+	t := r.roundTripper(ctx)
+	defer t.close()
+	in, err := r.resolve(ctx, t, origStr, oldBaseStr, newBaseStr)
+	if err != nil {
+		return nil, err
+	}
+	rebased, res, err := r.build(ctx, t, in)
 	if err != nil {
-		return fmt.Errorf("could not get config for original image %q: %v", origStr, err)
+		return nil, err
 	}
+	return r.publish(ctx, t, rebased, res, dsts)
+}
 
-	if oldBaseStr == "" && newBaseStr == "" {
-		oldBaseStr, newBaseStr, err = getBasesFromLabel(origConfig.Config.Labels)
-		if err != nil {
-			return err
+// publish pushes rebased, described by res, to dsts in the Push phase and
+// records where it went in res.
+func (r Rebaser) publish(ctx context.Context, t *contextTransport, rebased v1.Image, res *Result, dsts []destination) (*Result, error) {
+	pushCtx, cancel := t.phase(ctx, r.timeouts.Push)
+	defer cancel()
+	refs, err := r.push(t, rebased, dsts)
+	if err != nil {
+		if ctxErr := pushCtx.Err(); ctxErr != nil {
+			return nil, &RegistryError{Op: "put new image", Ref: dsts[0].str, Err: ctxErr, push: true}
 		}
-		fmt.Println("Found LABEL rebase", oldBaseStr, newBaseStr)
+		return nil, err
 	}
 
-	oldBase, err := r.get(oldBaseStr)
+	res.Reference = refs[0]
+	res.References = refs
+	return res, nil
+}
+
+// inputs are the images a rebase operates on, and the references they were
+// resolved from.
+type inputs struct {
+	orig, oldBase, newBase          v1.Image
+	origStr, oldBaseStr, newBaseStr string
+}
+
+// resolve fetches the original image and both bases, reading the bases from
+// the original's LABEL if neither is given.
+func (r Rebaser) resolve(ctx context.Context, t *contextTransport, origStr, oldBaseStr, newBaseStr string) (*inputs, error) {
+	return r.resolvePlatform(ctx, t, origStr, oldBaseStr, newBaseStr, false)
+}
+
+// resolvePlatform is like resolve, but if own is set the bases are selected
+// for the platform recorded in the original's config rather than for the
+// Rebaser's platform.
+func (r Rebaser) resolvePlatform(ctx context.Context, t *contextTransport, origStr, oldBaseStr, newBaseStr string, own bool) (*inputs, error) {
+	ctx, cancel := t.phase(ctx, r.timeouts.Resolve)
+	defer cancel()
+
+	orig, err := r.get(t, origStr)
 	if err != nil {
-		return fmt.Errorf("could not get old base image %q: %v", oldBaseStr, err)
+		return nil, &RegistryError{Op: "get original image", Ref: origStr, Err: t.withStatus(err)}
 	}
-	newBase, err := r.get(newBaseStr)
+	origConfig, err := orig.ConfigFile()
 	if err != nil {
-		return fmt.Errorf("could not get new base image %q: %v", newBaseStr, err)
+		return nil, &RegistryError{Op: "get config for original image", Ref: origStr, Err: t.withStatus(err)}
+	}
+	if own {
+		p, err := configPlatform(orig)
+		if err != nil {
+			return nil, &RegistryError{Op: "get config for original image", Ref: origStr, Err: t.withStatus(err)}
+		}
+		if p.OS == "" || p.Architecture == "" {
+			return nil, fmt.Errorf("config of %q does not record its platform", origStr)
+		}
+		r.platform = &p
 	}
 
-	// rebasedStr must be a tag.
-	rebasedRef, err := name.NewTag(rebasedStr, name.WeakValidation)
-	if err != nil {
-		return fmt.Errorf("could not parse rebased tag %q: %v", rebasedStr, err)
+	if oldBaseStr == "" && newBaseStr == "" {
+		oldBaseStr, newBaseStr, err = r.basesFromLabel(origConfig)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	rebased, err := mutate.Rebase(orig, oldBase, newBase)
+	oldBase, err := r.get(t, oldBaseStr)
 	if err != nil {
-		return fmt.Errorf("error rebasing image: %v", err)
+		return nil, &RegistryError{Op: "get old base image", Ref: oldBaseStr, Err: t.withStatus(err)}
 	}
-
-	// Push the new rebased image.
-	a, err := r.keychain.Resolve(rebasedRef.Context().Registry)
+	newBase, err := r.get(t, newBaseStr)
 	if err != nil {
-		return fmt.Errorf("could not authorize to %q: %v", rebasedRef.Context().Registry, err)
+		return nil, &RegistryError{Op: "get new base image", Ref: newBaseStr, Err: t.withStatus(err)}
 	}
-	if err := remote.Write(rebasedRef, rebased, a, r.transport); err != nil {
-		return fmt.Errorf("could not put new image %q: %v", rebasedStr, err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-
-	return nil
+	return &inputs{
+		orig:       orig,
+		oldBase:    oldBase,
+		newBase:    newBase,
+		origStr:    origStr,
+		oldBaseStr: oldBaseStr,
+		newBaseStr: newBaseStr,
+	}, nil
 }
 
-func getBasesFromLabel(lbls map[string]string) (string, string, error) {
-	if lbls == nil {
-		return "", "", errors.New("Could not find LABEL indicating bases")
+// build checks that the old base is a prefix of the original and stitches
+// the rebased image together. This reads the layer lists and the new base's
+// config.
+func (r Rebaser) build(ctx context.Context, t *contextTransport, in *inputs) (v1.Image, *Result, error) {
+	ctx, cancel := t.phase(ctx, r.timeouts.Validate)
+	defer cancel()
+
+	rebased, err := r.image(in.orig, in.oldBase, in.newBase)
+	if err != nil {
+		var nerr *NotBasedOnError
+		if errors.As(err, &nerr) {
+			nerr.Original, nerr.OldBase = in.origStr, in.oldBaseStr
+		}
+		var perr *PlatformMismatchError
+		if errors.As(err, &perr) {
+			perr.Original, perr.NewBase = in.origStr, in.newBaseStr
+		}
+		return nil, nil, err
 	}
-	lbl, found := lbls["rebase"]
-	if !found {
-		return "", "", errors.New("Could not find LABEL indicating bases")
+	res, err := newResult(in.orig, in.oldBase, in.newBase, rebased)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error rebasing image: %w", err)
 	}
-	parts := strings.Split(lbl, " ")
-	if len(parts) < 2 {
-		return "", "", fmt.Errorf("Malformed rebase LABEL: %s", lbl)
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
 	}
-	return parts[0], parts[1], nil
+	r.logger.Info("matched old base layers", "original", in.origStr, "kept", res.KeptLayers, "removed", res.RemovedLayers, "added", res.AddedLayers)
+	return rebased, res, nil
 }
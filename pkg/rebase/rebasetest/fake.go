@@ -0,0 +1,223 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rebasetest provides a fake rebase.Interface for use in tests.
+package rebasetest
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/google/image-rebase/pkg/rebase"
+)
+
+// Call records a single call made to a Fake.
+type Call struct {
+	// Method is the name of the method that was called.
+	Method string
+
+	Original string
+	OldBase  string
+	NewBase  string
+	Rebased  []string
+	// Inputs are the inputs of a call to RebaseMulti.
+	Inputs []rebase.PlatformInput
+}
+
+// Fake is a scriptable rebase.Interface that records every call made to it.
+// Its zero value succeeds, returning a Result that only names the rebased
+// references.
+type Fake struct {
+	// RebaseFunc, if set, handles calls to Rebase and RebaseContext.
+	// Otherwise they return Result and Err.
+	RebaseFunc func(ctx context.Context, orig, oldBase, newBase string, rebased ...string) (*rebase.Result, error)
+	// PlanFunc, if set, handles calls to Plan. Otherwise it returns
+	// PlanResult and Err.
+	PlanFunc func(ctx context.Context, orig, oldBase, newBase string, rebased ...string) (*rebase.Plan, error)
+	// ApplyFunc, if set, handles calls to Apply. Otherwise it returns Result
+	// and Err.
+	ApplyFunc func(ctx context.Context, pf *rebase.PlanFile) (*rebase.Result, error)
+	// RebaseIndexFunc and RebaseMultiFunc, if set, handle calls to
+	// RebaseIndex and RebaseMulti. Otherwise they return IndexResult and
+	// Err.
+	RebaseIndexFunc func(ctx context.Context, orig, oldBase, newBase string, rebased ...string) (*rebase.IndexResult, error)
+	RebaseMultiFunc func(ctx context.Context, inputs []rebase.PlatformInput, rebased ...string) (*rebase.IndexResult, error)
+	// RebaseArchiveFunc, if set, handles calls to RebaseArchive. Otherwise
+	// it returns ArchiveResult and Err.
+	RebaseArchiveFunc func(ctx context.Context, src, dst, oldBase, newBase string) (*rebase.ArchiveResult, error)
+	// ExportBundleFunc and ImportBundleFunc, if set, handle calls to
+	// ExportBundle and ImportBundle. Otherwise they return Result and Err,
+	// and ExportBundle writes nothing.
+	ExportBundleFunc func(ctx context.Context, w io.Writer, orig, oldBase, newBase string, rebased ...string) (*rebase.Result, error)
+	ImportBundleFunc func(ctx context.Context, path string, rebased ...string) (*rebase.Result, error)
+
+	Result        *rebase.Result
+	PlanResult    *rebase.Plan
+	IndexResult   *rebase.IndexResult
+	ArchiveResult *rebase.ArchiveResult
+	Err           error
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+var _ rebase.Interface = (*Fake)(nil)
+
+// Calls returns the calls made to f so far, in order.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+func (f *Fake) record(method, orig, oldBase, newBase string, rebased []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, Call{
+		Method:   method,
+		Original: orig,
+		OldBase:  oldBase,
+		NewBase:  newBase,
+		Rebased:  append([]string(nil), rebased...),
+	})
+}
+
+// Rebase implements rebase.Interface
+func (f *Fake) Rebase(orig, oldBase, newBase string, rebased ...string) (*rebase.Result, error) {
+	f.record("Rebase", orig, oldBase, newBase, rebased)
+	return f.rebase(context.Background(), orig, oldBase, newBase, rebased)
+}
+
+// RebaseContext implements rebase.Interface
+func (f *Fake) RebaseContext(ctx context.Context, orig, oldBase, newBase string, rebased ...string) (*rebase.Result, error) {
+	f.record("RebaseContext", orig, oldBase, newBase, rebased)
+	return f.rebase(ctx, orig, oldBase, newBase, rebased)
+}
+
+func (f *Fake) rebase(ctx context.Context, orig, oldBase, newBase string, rebased []string) (*rebase.Result, error) {
+	if f.RebaseFunc != nil {
+		return f.RebaseFunc(ctx, orig, oldBase, newBase, rebased...)
+	}
+	if f.Result != nil || f.Err != nil {
+		return f.Result, f.Err
+	}
+	return newResult(rebased), nil
+}
+
+// Plan implements rebase.Interface
+func (f *Fake) Plan(ctx context.Context, orig, oldBase, newBase string, rebased ...string) (*rebase.Plan, error) {
+	f.record("Plan", orig, oldBase, newBase, rebased)
+	if f.PlanFunc != nil {
+		return f.PlanFunc(ctx, orig, oldBase, newBase, rebased...)
+	}
+	if f.PlanResult != nil || f.Err != nil {
+		return f.PlanResult, f.Err
+	}
+	return &rebase.Plan{Result: *newResult(rebased)}, nil
+}
+
+// Apply implements rebase.Interface. The call is recorded with the
+// references and destinations of pf.
+func (f *Fake) Apply(ctx context.Context, pf *rebase.PlanFile) (*rebase.Result, error) {
+	f.record("Apply", pf.Original.Ref, pf.OldBase.Ref, pf.NewBase.Ref, pf.Destinations)
+	if f.ApplyFunc != nil {
+		return f.ApplyFunc(ctx, pf)
+	}
+	if f.Result != nil || f.Err != nil {
+		return f.Result, f.Err
+	}
+	res := newResult(pf.Destinations)
+	res.Digest = pf.Digest
+	return res, nil
+}
+
+// RebaseIndex implements rebase.Interface
+func (f *Fake) RebaseIndex(ctx context.Context, orig, oldBase, newBase string, rebased ...string) (*rebase.IndexResult, error) {
+	f.record("RebaseIndex", orig, oldBase, newBase, rebased)
+	if f.RebaseIndexFunc != nil {
+		return f.RebaseIndexFunc(ctx, orig, oldBase, newBase, rebased...)
+	}
+	return f.indexResult(rebased)
+}
+
+// RebaseMulti implements rebase.Interface. The call is recorded with its
+// inputs in Inputs.
+func (f *Fake) RebaseMulti(ctx context.Context, inputs []rebase.PlatformInput, rebased ...string) (*rebase.IndexResult, error) {
+	f.record("RebaseMulti", "", "", "", rebased)
+	f.mu.Lock()
+	f.calls[len(f.calls)-1].Inputs = append([]rebase.PlatformInput(nil), inputs...)
+	f.mu.Unlock()
+	if f.RebaseMultiFunc != nil {
+		return f.RebaseMultiFunc(ctx, inputs, rebased...)
+	}
+	return f.indexResult(rebased)
+}
+
+func (f *Fake) indexResult(rebased []string) (*rebase.IndexResult, error) {
+	if f.IndexResult != nil || f.Err != nil {
+		return f.IndexResult, f.Err
+	}
+	res := newResult(rebased)
+	return &rebase.IndexResult{Reference: res.Reference, References: res.References}, nil
+}
+
+// RebaseArchive implements rebase.Interface. The call is recorded with src
+// as the original and dst as the only rebased reference.
+func (f *Fake) RebaseArchive(ctx context.Context, src, dst, oldBase, newBase string) (*rebase.ArchiveResult, error) {
+	f.record("RebaseArchive", src, oldBase, newBase, []string{dst})
+	if f.RebaseArchiveFunc != nil {
+		return f.RebaseArchiveFunc(ctx, src, dst, oldBase, newBase)
+	}
+	if f.ArchiveResult != nil || f.Err != nil {
+		return f.ArchiveResult, f.Err
+	}
+	return &rebase.ArchiveResult{}, nil
+}
+
+// ExportBundle implements rebase.Interface
+func (f *Fake) ExportBundle(ctx context.Context, w io.Writer, orig, oldBase, newBase string, rebased ...string) (*rebase.Result, error) {
+	f.record("ExportBundle", orig, oldBase, newBase, rebased)
+	if f.ExportBundleFunc != nil {
+		return f.ExportBundleFunc(ctx, w, orig, oldBase, newBase, rebased...)
+	}
+	if f.Result != nil || f.Err != nil {
+		return f.Result, f.Err
+	}
+	return &rebase.Result{}, nil
+}
+
+// ImportBundle implements rebase.Interface. The call is recorded with path
+// as the original.
+func (f *Fake) ImportBundle(ctx context.Context, path string, rebased ...string) (*rebase.Result, error) {
+	f.record("ImportBundle", path, "", "", rebased)
+	if f.ImportBundleFunc != nil {
+		return f.ImportBundleFunc(ctx, path, rebased...)
+	}
+	if f.Result != nil || f.Err != nil {
+		return f.Result, f.Err
+	}
+	return newResult(rebased), nil
+}
+
+// newResult returns a Result naming only the rebased references.
+func newResult(rebased []string) *rebase.Result {
+	res := &rebase.Result{References: append([]string(nil), rebased...)}
+	if len(rebased) > 0 {
+		res.Reference = rebased[0]
+	}
+	return res
+}
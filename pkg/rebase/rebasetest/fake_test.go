@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebasetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/image-rebase/pkg/rebase"
+)
+
+func TestFakeImplementsInterface(t *testing.T) {
+	var i rebase.Interface = &Fake{}
+	if _, err := i.Rebase("app:1", "old:1", "new:1", "out:1"); err != nil {
+		t.Errorf("Rebase() = %v", err)
+	}
+}
+
+func TestFakeRecordsCalls(t *testing.T) {
+	var f Fake
+	ctx := context.Background()
+	inputs := []rebase.PlatformInput{{Original: "app:amd64"}, {Original: "app:arm64"}}
+
+	res, err := f.Rebase("app:1", "old:1", "new:1", "out:1", "out:2")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	if res.Reference != "out:1" || !reflect.DeepEqual(res.References, []string{"out:1", "out:2"}) {
+		t.Errorf("Rebase() = %+v, want a Result naming out:1 and out:2", res)
+	}
+	f.RebaseContext(ctx, "app:1", "", "", "out:1")
+	f.Plan(ctx, "app:1", "old:1", "new:1", "out:1")
+	f.Apply(ctx, &rebase.PlanFile{Original: rebase.PinnedImage{Ref: "app:1"}, OldBase: rebase.PinnedImage{Ref: "old:1"}, NewBase: rebase.PinnedImage{Ref: "new:1"}, Destinations: []string{"out:1"}})
+	f.RebaseIndex(ctx, "app:1", "old:1", "new:1", "out:1")
+	f.RebaseMulti(ctx, inputs, "out:1")
+	f.RebaseArchive(ctx, "in.tar", "out.tar", "old:1", "new:1")
+	f.ExportBundle(ctx, &bytes.Buffer{}, "app:1", "old:1", "new:1", "out:1")
+	f.ImportBundle(ctx, "bundle.tar", "out:1")
+
+	want := []Call{
+		{Method: "Rebase", Original: "app:1", OldBase: "old:1", NewBase: "new:1", Rebased: []string{"out:1", "out:2"}},
+		{Method: "RebaseContext", Original: "app:1", Rebased: []string{"out:1"}},
+		{Method: "Plan", Original: "app:1", OldBase: "old:1", NewBase: "new:1", Rebased: []string{"out:1"}},
+		{Method: "Apply", Original: "app:1", OldBase: "old:1", NewBase: "new:1", Rebased: []string{"out:1"}},
+		{Method: "RebaseIndex", Original: "app:1", OldBase: "old:1", NewBase: "new:1", Rebased: []string{"out:1"}},
+		{Method: "RebaseMulti", Rebased: []string{"out:1"}, Inputs: inputs},
+		{Method: "RebaseArchive", Original: "in.tar", OldBase: "old:1", NewBase: "new:1", Rebased: []string{"out.tar"}},
+		{Method: "ExportBundle", Original: "app:1", OldBase: "old:1", NewBase: "new:1", Rebased: []string{"out:1"}},
+		{Method: "ImportBundle", Original: "bundle.tar", Rebased: []string{"out:1"}},
+	}
+	if got := f.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Calls() = %+v, want %+v", got, want)
+	}
+}
+
+func TestFakeScripted(t *testing.T) {
+	errFake := errors.New("fake")
+	f := Fake{
+		Err: errFake,
+		RebaseIndexFunc: func(ctx context.Context, orig, oldBase, newBase string, rebased ...string) (*rebase.IndexResult, error) {
+			return &rebase.IndexResult{Reference: orig}, nil
+		},
+	}
+	if _, err := f.Rebase("app:1", "old:1", "new:1", "out:1"); err != errFake {
+		t.Errorf("Rebase() = %v, want %v", err, errFake)
+	}
+	res, err := f.RebaseIndex(context.Background(), "app:1", "old:1", "new:1", "out:1")
+	if err != nil || res.Reference != "app:1" {
+		t.Errorf("RebaseIndex() = %+v, %v, want the result of RebaseIndexFunc", res, err)
+	}
+	if n := len(f.Calls()); n != 2 {
+		t.Errorf("recorded %d calls, want 2", n)
+	}
+}
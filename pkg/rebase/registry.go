@@ -0,0 +1,79 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// client returns an HTTP client authorized for scope on repo.
+func (r Rebaser) client(t http.RoundTripper, repo name.Repository, scope string) (*http.Client, error) {
+	a, err := r.keychain.Resolve(repo.Registry)
+	if err != nil {
+		return nil, &RegistryError{Op: "authorize to", Ref: repo.RegistryStr(), Err: fmt.Errorf("%w: %v", ErrUnauthorized, err)}
+	}
+	tr, err := transport.New(repo.Registry, a, t, []string{repo.Scope(scope)})
+	if err != nil {
+		return nil, &RegistryError{Op: "authorize to", Ref: repo.String(), Err: err}
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// blobExists reports whether the blob h exists in repo.
+func blobExists(client *http.Client, repo name.Repository, h v1.Hash) (bool, error) {
+	u := url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/blobs/%s", repo.RepositoryStr(), h),
+	}
+	resp, err := client.Head(u.String())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusNotFound); err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// mountableImage hints to remote.Write that the layers of an image can be
+// mounted from the repository of ref.
+type mountableImage struct {
+	v1.Image
+	ref name.Reference
+}
+
+// Layers implements v1.Image
+func (i *mountableImage) Layers() ([]v1.Layer, error) {
+	ls, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for n, l := range ls {
+		ls[n] = &remote.MountableLayer{Layer: l, Reference: i.ref}
+	}
+	return ls, nil
+}
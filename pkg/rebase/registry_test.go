@@ -0,0 +1,263 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// testRegistry is a minimal in-memory registry, enough for the requests the
+// vendored remote package and this package make.
+type testRegistry struct {
+	host string
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]map[string][]byte
+	types     map[string]string
+	uploads   map[string][]byte
+	next      int
+	// requests lists the method and path of every request served.
+	requests []string
+	// fail, if set, can answer a request with a status and body instead.
+	fail func(r *http.Request) (int, string)
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+	reg := &testRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string]map[string][]byte{},
+		types:     map[string]string{},
+		uploads:   map[string][]byte{},
+	}
+	s := httptest.NewServer(reg)
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.host = u.Host
+	return reg
+}
+
+func digestOf(b []byte) string {
+	h := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// ServeHTTP implements http.Handler
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.requests = append(reg.requests, r.Method+" "+r.URL.Path)
+	if reg.fail != nil {
+		if status, body := reg.fail(r); status != 0 {
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+			return
+		}
+	}
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(p, "/manifests/"):
+		i := strings.Index(p, "/manifests/")
+		reg.serveManifest(w, r, p[:i], p[i+len("/manifests/"):])
+	case strings.Contains(p, "/blobs/uploads/"):
+		i := strings.Index(p, "/blobs/uploads/")
+		reg.serveUpload(w, r, p[:i], p[i+len("/blobs/uploads/"):])
+	case strings.Contains(p, "/blobs/"):
+		b, ok := reg.blobs[p[strings.Index(p, "/blobs/")+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (reg *testRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	if reg.manifests[repo] == nil {
+		reg.manifests[repo] = map[string][]byte{}
+	}
+	switch r.Method {
+	case http.MethodPut:
+		b, _ := ioutil.ReadAll(r.Body)
+		reg.putManifest(repo, ref, b, r.Header.Get("Content-Type"))
+		w.Header().Set("Docker-Content-Digest", digestOf(b))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		b, ok := reg.manifests[repo][ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		w.Header().Set("Content-Type", reg.types[digestOf(b)])
+		w.Header().Set("Docker-Content-Digest", digestOf(b))
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	}
+}
+
+func (reg *testRegistry) putManifest(repo, ref string, b []byte, mt string) {
+	if reg.manifests[repo] == nil {
+		reg.manifests[repo] = map[string][]byte{}
+	}
+	reg.manifests[repo][ref] = b
+	reg.manifests[repo][digestOf(b)] = b
+	reg.types[digestOf(b)] = mt
+}
+
+func (reg *testRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	switch r.Method {
+	case http.MethodPost:
+		if h := r.URL.Query().Get("mount"); h != "" && r.URL.Query().Get("from") != "" {
+			if _, ok := reg.blobs[h]; ok {
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		reg.next++
+		id := fmt.Sprint(reg.next)
+		reg.uploads[id] = nil
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		b, _ := ioutil.ReadAll(r.Body)
+		reg.uploads[id] = append(reg.uploads[id], b...)
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		b, _ := ioutil.ReadAll(r.Body)
+		b = append(reg.uploads[id], b...)
+		if digestOf(b) != r.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"digest invalid"}]}`)
+			return
+		}
+		reg.blobs[digestOf(b)] = b
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// has reports whether repo holds a manifest for ref.
+func (reg *testRegistry) has(repo, ref string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	_, ok := reg.manifests[repo][ref]
+	return ok
+}
+
+// count returns how many requests with method were made to a path with the
+// given prefix.
+func (reg *testRegistry) count(method, prefix string) int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	n := 0
+	for _, r := range reg.requests {
+		if strings.HasPrefix(r, method+" "+prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// push writes img to s, a reference relative to the registry.
+func (reg *testRegistry) push(t *testing.T, s string, img v1.Image) {
+	t.Helper()
+	ref, err := name.ParseReference(reg.host+"/"+s, name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, authn.Anonymous, http.DefaultTransport); err != nil {
+		t.Fatalf("remote.Write(%s) = %v", s, err)
+	}
+}
+
+// testImages returns an old base, a new base, and an original made of the
+// old base and one more layer.
+func testImages(t *testing.T) (orig, oldBase, newBase v1.Image) {
+	t.Helper()
+	oldBase, err := random.Image(64, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBase, err = random.Image(64, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := top.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err = mutate.AppendLayers(oldBase, ls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return orig, oldBase, newBase
+}
+
+// pushTestImages pushes the images from testImages to app:1, old:1 and
+// new:1.
+func (reg *testRegistry) pushTestImages(t *testing.T) (orig, oldBase, newBase v1.Image) {
+	t.Helper()
+	orig, oldBase, newBase = testImages(t)
+	reg.push(t, "app:1", orig)
+	reg.push(t, "old:1", oldBase)
+	reg.push(t, "new:1", newBase)
+	return orig, oldBase, newBase
+}
+
+func mustDigest(t *testing.T, img v1.Image) v1.Hash {
+	t.Helper()
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Result describes a rebased image.
+type Result struct {
+	// Reference is the first reference the rebased image was pushed to, and
+	// References lists all of them. Destinations given as a bare repository
+	// appear as digest references.
+	Reference  string
+	References []string
+	// Digest is the digest of the rebased image's manifest.
+	Digest v1.Hash
+
+	// Original, OldBase and NewBase are the manifest digests the inputs
+	// resolved to.
+	Original v1.Hash
+	OldBase  v1.Hash
+	NewBase  v1.Hash
+
+	// KeptLayers is the number of layers of the original image above the
+	// old base, which were carried over unchanged.
+	KeptLayers int
+	// RemovedLayers is the number of old base layers that were dropped, and
+	// AddedLayers the number of new base layers that replaced them.
+	RemovedLayers int
+	AddedLayers   int
+
+	// ManifestSize is the size in bytes of the rebased manifest, ConfigSize
+	// that of its config and LayersSize the total compressed size of its
+	// layers.
+	ManifestSize int64
+	ConfigSize   int64
+	LayersSize   int64
+}
+
+// newResult describes rebased, which was built from orig, oldBase and newBase.
+func newResult(orig, oldBase, newBase, rebased v1.Image) (*Result, error) {
+	var res Result
+	var err error
+	if res.Original, err = orig.Digest(); err != nil {
+		return nil, err
+	}
+	if res.OldBase, err = oldBase.Digest(); err != nil {
+		return nil, err
+	}
+	if res.NewBase, err = newBase.Digest(); err != nil {
+		return nil, err
+	}
+	if res.Digest, err = rebased.Digest(); err != nil {
+		return nil, err
+	}
+
+	origLayers, err := orig.Layers()
+	if err != nil {
+		return nil, err
+	}
+	oldBaseLayers, err := oldBase.Layers()
+	if err != nil {
+		return nil, err
+	}
+	newBaseLayers, err := newBase.Layers()
+	if err != nil {
+		return nil, err
+	}
+	res.KeptLayers = len(origLayers) - len(oldBaseLayers)
+	res.RemovedLayers = len(oldBaseLayers)
+	res.AddedLayers = len(newBaseLayers)
+
+	raw, err := rebased.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	res.ManifestSize = int64(len(raw))
+	m, err := rebased.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	res.ConfigSize = m.Config.Size
+	for _, l := range m.Layers {
+		res.LayersSize += l.Size
+	}
+	return &res, nil
+}
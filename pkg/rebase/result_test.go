@@ -0,0 +1,69 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestRebaseResult(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, oldBase, newBase := reg.pushTestImages(t)
+
+	res, err := New(nil, nil).Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1", reg.host+"/out", reg.host+"/other:2")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+
+	reg.mu.Lock()
+	raw := reg.manifests["out"]["1"]
+	reg.mu.Unlock()
+	h, err := v1.NewHash(digestOf(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Result{
+		Reference:     reg.host + "/out:1",
+		References:    []string{reg.host + "/out:1", reg.host + "/out@" + h.String(), reg.host + "/other:2"},
+		Digest:        h,
+		Original:      mustDigest(t, orig),
+		OldBase:       mustDigest(t, oldBase),
+		NewBase:       mustDigest(t, newBase),
+		KeptLayers:    1,
+		RemovedLayers: 2,
+		AddedLayers:   3,
+		ManifestSize:  int64(len(raw)),
+		ConfigSize:    m.Config.Size,
+	}
+	for _, l := range m.Layers {
+		want.LayersSize += l.Size
+	}
+	if !reflect.DeepEqual(*res, want) {
+		t.Errorf("Rebase() = %+v, want %+v", *res, want)
+	}
+	if !reg.has("other", "2") || !reg.has("out", h.String()) {
+		t.Error("rebased image was not pushed to every reference")
+	}
+}
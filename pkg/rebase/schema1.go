@@ -0,0 +1,336 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/v1util"
+)
+
+// emptyLayer is the digest of the gzipped empty tar archive that schema 1
+// manifests list for history entries that did not change the filesystem.
+const emptyLayer = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+
+// schema1Manifest is a Docker image manifest, schema version 1. Its layers
+// and history are listed newest first.
+type schema1Manifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Architecture  string `json:"architecture"`
+	FSLayers      []struct {
+		BlobSum v1.Hash `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// v1Compatibility holds the fields of a schema 1 history entry that are
+// carried into the history of the converted config.
+type v1Compatibility struct {
+	Created         v1.Time `json:"created"`
+	Author          string  `json:"author"`
+	Comment         string  `json:"comment"`
+	Throwaway       bool    `json:"throwaway"`
+	ContainerConfig struct {
+		Cmd []string
+	} `json:"container_config"`
+}
+
+// isSchema1 reports whether raw, served with media type mt, is a schema 1
+// manifest. Some registries serve those as plain JSON.
+func isSchema1(raw []byte, mt types.MediaType) bool {
+	if mt == types.DockerManifestSchema1 || mt == types.DockerManifestSchema1Signed {
+		return true
+	}
+	var v struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	return json.Unmarshal(raw, &v) == nil && v.SchemaVersion == 1
+}
+
+// fromSchema1 converts src, an image with a signed or unsigned schema 1
+// manifest, into an image with an equivalent schema 2 manifest and config.
+// The config is taken from the newest history entry, and its history from
+// all of them. Computing the diff IDs reads every layer of src, which is done
+// the first time the config or manifest is needed.
+//
+// The layers of the returned image can be mounted from the repository of ref.
+// Its digest is still h, that of the schema 1 manifest, so that it identifies
+// the image that was read.
+func fromSchema1(src v1.Image, ref name.Reference, h v1.Hash) (v1.Image, error) {
+	raw, err := src.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	var m schema1Manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("could not parse schema 1 manifest: %w", err)
+	}
+	if m.SchemaVersion != 1 || len(m.History) == 0 || len(m.History) != len(m.FSLayers) {
+		return nil, errors.New("malformed schema 1 manifest")
+	}
+	img, err := partial.CompressedToImage(&schema1Core{src: src, manifest: m})
+	if err != nil {
+		return nil, err
+	}
+	return &schema1Image{Image: &mountableImage{Image: img, ref: ref}, digest: h}, nil
+}
+
+// schema1Payload returns the payload of raw, a schema 1 manifest, which is
+// what its signatures sign and what its digest is computed over. A signed
+// manifest is its payload with the signatures spliced in before the end; the
+// protected header of each signature records the length of the payload up
+// to that point and the tail that followed it.
+func schema1Payload(raw []byte) ([]byte, error) {
+	var m struct {
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("could not parse schema 1 manifest: %w", err)
+	}
+	if len(m.Signatures) == 0 {
+		return raw, nil
+	}
+	b, err := joseDecode(m.Signatures[0].Protected)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode protected header of schema 1 signature: %w", err)
+	}
+	var protected struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}
+	if err := json.Unmarshal(b, &protected); err != nil {
+		return nil, fmt.Errorf("could not parse protected header of schema 1 signature: %w", err)
+	}
+	tail, err := joseDecode(protected.FormatTail)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode format tail of schema 1 signature: %w", err)
+	}
+	if protected.FormatLength <= 0 || protected.FormatLength > len(raw) {
+		return nil, fmt.Errorf("schema 1 signature has format length %d, but the manifest is %d bytes", protected.FormatLength, len(raw))
+	}
+	payload := make([]byte, 0, protected.FormatLength+len(tail))
+	return append(append(payload, raw[:protected.FormatLength]...), tail...), nil
+}
+
+// joseDecode decodes s, which is base64url encoded with its padding removed,
+// as in JSON Web Signatures.
+func joseDecode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// schema1Image is the v1.Image of a converted schema 1 image.
+type schema1Image struct {
+	v1.Image
+	digest v1.Hash
+}
+
+// Digest implements v1.Image
+func (i *schema1Image) Digest() (v1.Hash, error) {
+	return i.digest, nil
+}
+
+// schema1Core implements partial.CompressedImageCore
+type schema1Core struct {
+	src      v1.Image
+	manifest schema1Manifest
+
+	once   sync.Once
+	err    error
+	config []byte
+	raw    []byte
+	sizes  map[v1.Hash]int64
+}
+
+// MediaType implements partial.CompressedImageCore
+func (c *schema1Core) MediaType() (types.MediaType, error) {
+	return types.DockerManifestSchema2, nil
+}
+
+// RawManifest implements partial.CompressedImageCore
+func (c *schema1Core) RawManifest() ([]byte, error) {
+	c.once.Do(c.convert)
+	return c.raw, c.err
+}
+
+// RawConfigFile implements partial.CompressedImageCore
+func (c *schema1Core) RawConfigFile() ([]byte, error) {
+	c.once.Do(c.convert)
+	return c.config, c.err
+}
+
+// LayerByDigest implements partial.CompressedImageCore
+func (c *schema1Core) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	return &schema1Layer{core: c, digest: h}, nil
+}
+
+// convert builds the config and schema 2 manifest of the image.
+func (c *schema1Core) convert() {
+	c.config, c.raw, c.err = c.build()
+}
+
+func (c *schema1Core) build() ([]byte, []byte, error) {
+	var cfg v1.ConfigFile
+	if err := json.Unmarshal([]byte(c.manifest.History[0].V1Compatibility), &cfg); err != nil {
+		return nil, nil, fmt.Errorf("could not parse schema 1 history: %w", err)
+	}
+	if cfg.Architecture == "" {
+		cfg.Architecture = c.manifest.Architecture
+	}
+	if cfg.OS == "" {
+		cfg.OS = "linux"
+	}
+	cfg.RootFS = v1.RootFS{Type: "layers"}
+	cfg.History = nil
+
+	m := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestSchema2,
+	}
+	c.sizes = map[v1.Hash]int64{}
+	for i := len(c.manifest.History) - 1; i >= 0; i-- {
+		var compat v1Compatibility
+		if err := json.Unmarshal([]byte(c.manifest.History[i].V1Compatibility), &compat); err != nil {
+			return nil, nil, fmt.Errorf("could not parse schema 1 history: %w", err)
+		}
+		blob := c.manifest.FSLayers[i].BlobSum
+		empty := compat.Throwaway || blob.String() == emptyLayer
+		cfg.History = append(cfg.History, v1.History{
+			Author:     compat.Author,
+			Created:    compat.Created,
+			CreatedBy:  strings.Join(compat.ContainerConfig.Cmd, " "),
+			Comment:    compat.Comment,
+			EmptyLayer: empty,
+		})
+		if empty {
+			continue
+		}
+
+		diffID, size, err := c.diffID(blob)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read layer %s: %w", blob, err)
+		}
+		c.sizes[blob] = size
+		cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs, diffID)
+		m.Layers = append(m.Layers, v1.Descriptor{
+			MediaType: types.DockerLayer,
+			Size:      size,
+			Digest:    blob,
+		})
+	}
+
+	config, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.Config = v1.Descriptor{MediaType: types.DockerConfigJSON, Size: int64(len(config))}
+	if m.Config.Digest, _, err = v1.SHA256(bytes.NewReader(config)); err != nil {
+		return nil, nil, err
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, raw, nil
+}
+
+// diffID reads the layer with digest h and returns its diff ID and
+// compressed size.
+func (c *schema1Core) diffID(h v1.Hash) (v1.Hash, int64, error) {
+	l, err := c.src.LayerByDigest(h)
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	cr := &countingReader{Reader: rc}
+	zr, err := v1util.GunzipReadCloser(ioutil.NopCloser(cr))
+	if err != nil {
+		rc.Close()
+		return v1.Hash{}, 0, err
+	}
+	diffID, _, err := v1.SHA256(zr)
+	if err == nil {
+		// Count any trailing bytes the gzip reader left unread.
+		_, err = io.Copy(ioutil.Discard, cr)
+	}
+	zr.Close()
+	rc.Close()
+	return diffID, cr.n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// schema1Layer implements partial.CompressedLayer
+type schema1Layer struct {
+	core   *schema1Core
+	digest v1.Hash
+}
+
+// Digest implements partial.CompressedLayer
+func (l *schema1Layer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+// Compressed implements partial.CompressedLayer
+func (l *schema1Layer) Compressed() (io.ReadCloser, error) {
+	src, err := l.core.src.LayerByDigest(l.digest)
+	if err != nil {
+		return nil, err
+	}
+	return src.Compressed()
+}
+
+// Size implements partial.CompressedLayer
+func (l *schema1Layer) Size() (int64, error) {
+	l.core.once.Do(l.core.convert)
+	if l.core.err != nil {
+		return 0, l.core.err
+	}
+	size, ok := l.core.sizes[l.digest]
+	if !ok {
+		return 0, fmt.Errorf("blob %v not found in manifest", l.digest)
+	}
+	return size, nil
+}
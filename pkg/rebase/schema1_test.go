@@ -0,0 +1,237 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// schema1History is a schema 1 history entry with the config of the image,
+// as found in the newest entry.
+type schema1History struct {
+	ID           string            `json:"id"`
+	Created      time.Time         `json:"created"`
+	Architecture string            `json:"architecture,omitempty"`
+	OS           string            `json:"os,omitempty"`
+	Config       *v1.Config        `json:"config,omitempty"`
+	Container    map[string]string `json:"container_config,omitempty"`
+}
+
+// pushSchema1 pushes the layers of img to repo, along with a schema 1
+// manifest for them tagged 1, signed if sign is set. It returns the digest
+// of the manifest's payload, by which the registry also serves it.
+func (reg *testRegistry) pushSchema1(t *testing.T, repo string, img v1.Image, sign bool) v1.Hash {
+	t.Helper()
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m schema1Manifest
+	m.SchemaVersion = 1
+	m.Architecture = "amd64"
+	for i := len(ls) - 1; i >= 0; i-- {
+		rc, err := ls[i].Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reg.mu.Lock()
+		reg.blobs[digestOf(b)] = b
+		reg.mu.Unlock()
+
+		h := schema1History{ID: fmt.Sprint(i), Created: time.Unix(int64(i), 0).UTC()}
+		if i == len(ls)-1 {
+			h.Architecture, h.OS = "amd64", "linux"
+			h.Config = &v1.Config{Env: []string{"SCHEMA=1"}}
+		}
+		compat, err := json.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.FSLayers = append(m.FSLayers, struct {
+			BlobSum v1.Hash `json:"blobSum"`
+		}{mustLayerDigest(t, ls[i])})
+		m.History = append(m.History, struct {
+			V1Compatibility string `json:"v1Compatibility"`
+		}{string(compat)})
+	}
+	payload, err := json.MarshalIndent(m, "", "   ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, mt := payload, types.DockerManifestSchema1
+	if sign {
+		raw, mt = signSchema1(t, payload), types.DockerManifestSchema1Signed
+	}
+	h := v1.Hash{Algorithm: "sha256", Hex: digestOf(payload)[len("sha256:"):]}
+	reg.mu.Lock()
+	reg.putManifest(repo, "1", raw, string(mt))
+	reg.putManifest(repo, h.String(), raw, string(mt))
+	reg.mu.Unlock()
+	return h
+}
+
+// signSchema1 splices a signature into payload the way libtrust does. The
+// signature itself is not valid, since nothing here checks it.
+func signSchema1(t *testing.T, payload []byte) []byte {
+	t.Helper()
+	n := bytes.LastIndex(payload, []byte("\n}"))
+	tail := payload[n:]
+	protected, err := json.Marshal(map[string]interface{}{
+		"formatLength": n,
+		"formatTail":   base64.RawURLEncoding.EncodeToString(tail),
+		"time":         "2018-01-01T00:00:00Z",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs := fmt.Sprintf(",\n   \"signatures\": [\n      {\n         \"header\": {\"alg\": \"ES256\"},\n         \"signature\": \"c2lnbmF0dXJl\",\n         \"protected\": %q\n      }\n   ]",
+		base64.RawURLEncoding.EncodeToString(protected))
+	var b bytes.Buffer
+	b.Write(payload[:n])
+	b.WriteString(sigs)
+	b.Write(tail)
+	return b.Bytes()
+}
+
+func mustLayerDigest(t *testing.T, l v1.Layer) v1.Hash {
+	t.Helper()
+	h, err := l.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestSchema1Payload(t *testing.T) {
+	payload := []byte("{\n   \"schemaVersion\": 1\n}")
+	signed := signSchema1(t, payload)
+	for _, raw := range [][]byte{payload, signed} {
+		got, err := schema1Payload(raw)
+		if err != nil {
+			t.Fatalf("schema1Payload() = %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("schema1Payload(%s) = %s, want %s", raw, got, payload)
+		}
+	}
+}
+
+func TestRebaseSchema1(t *testing.T) {
+	for _, sign := range []bool{false, true} {
+		for _, byDigest := range []bool{false, true} {
+			t.Run(fmt.Sprintf("signed=%v,digest=%v", sign, byDigest), func(t *testing.T) {
+				reg := newTestRegistry(t)
+				orig, oldBase, newBase := testImages(t)
+				reg.push(t, "old:1", oldBase)
+				reg.push(t, "new:1", newBase)
+				h := reg.pushSchema1(t, "legacy", orig, sign)
+
+				origStr := reg.host + "/legacy:1"
+				if byDigest {
+					origStr = reg.host + "/legacy@" + h.String()
+				}
+				res, err := New(nil, nil).Rebase(origStr, reg.host+"/old:1", reg.host+"/new:1", reg.host+"/legacy:2")
+				if err != nil {
+					t.Fatalf("Rebase() = %v", err)
+				}
+				if res.Original != h {
+					t.Errorf("Original = %s, want %s", res.Original, h)
+				}
+				if res.KeptLayers != 1 || res.RemovedLayers != 2 || res.AddedLayers != 3 {
+					t.Errorf("kept %d, removed %d, added %d layers, want 1, 2, 3", res.KeptLayers, res.RemovedLayers, res.AddedLayers)
+				}
+				reg.mu.Lock()
+				raw := reg.manifests["legacy"]["2"]
+				reg.mu.Unlock()
+				m, err := v1.ParseManifest(bytes.NewReader(raw))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if m.MediaType != types.DockerManifestSchema2 {
+					t.Errorf("rebased media type = %s, want %s", m.MediaType, types.DockerManifestSchema2)
+				}
+				reg.mu.Lock()
+				cfg, err := v1.ParseConfigFile(bytes.NewReader(reg.blobs[m.Config.Digest.String()]))
+				reg.mu.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(cfg.Config.Env) != 1 || cfg.Config.Env[0] != "SCHEMA=1" {
+					t.Errorf("rebased Env = %v, want [SCHEMA=1]", cfg.Config.Env)
+				}
+			})
+		}
+	}
+}
+
+func TestSchema1WrongDigest(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, _, _ := testImages(t)
+	h := reg.pushSchema1(t, "legacy", orig, true)
+	reg.mu.Lock()
+	// Serve the manifest under a digest it does not have.
+	reg.manifests["legacy"]["sha256:"+zeros] = reg.manifests["legacy"][h.String()]
+	reg.mu.Unlock()
+	_, err := New(nil, nil).Rebase(reg.host+"/legacy@sha256:"+zeros, reg.host+"/legacy:1", reg.host+"/legacy:1", reg.host+"/legacy:2")
+	if err == nil || !strings.Contains(err.Error(), "has digest "+h.String()) {
+		t.Errorf("Rebase() = %v, want an error for digest %s", err, h)
+	}
+}
+
+func TestRebaseIndexSchema1Child(t *testing.T) {
+	reg := newTestRegistry(t)
+	orig, oldBase, newBase := testImages(t)
+	h := reg.pushSchema1(t, "legacy", orig, true)
+	raw, err := json.Marshal(v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestList,
+		Manifests:     []v1.Descriptor{{MediaType: types.DockerManifestSchema1Signed, Digest: h, Platform: &amd64}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.mu.Lock()
+	reg.putManifest("legacy", "index", raw, string(types.DockerManifestList))
+	reg.mu.Unlock()
+	reg.pushIndex(t, "old", "1", indexEntry{platform: amd64, img: oldBase})
+	reg.pushIndex(t, "new", "1", indexEntry{platform: amd64, img: newBase})
+
+	// The child is read by the digest of its payload.
+	res, err := New(nil, nil).RebaseIndex(context.Background(), reg.host+"/legacy:index", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+	if err != nil {
+		t.Fatalf("RebaseIndex() = %v", err)
+	}
+	if got := res.Platforms[0].Result.Original; got != h {
+		t.Errorf("Original = %s, want %s", got, h)
+	}
+}
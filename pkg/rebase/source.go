@@ -0,0 +1,284 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ImageSource reads images for references of one scheme.
+type ImageSource interface {
+	// Image returns the image that ref, without its scheme, refers to. ctx
+	// is bound to the phase of the rebase that needs the image, which may
+	// be over before the image's blobs are read.
+	Image(ctx context.Context, ref string) (v1.Image, error)
+}
+
+// ImageSink writes images for references of one scheme.
+type ImageSink interface {
+	// Write writes img to each of refs, which are given without their
+	// scheme, and returns the references it was written to in the same
+	// order. These are reported in Result.References.
+	Write(ctx context.Context, img v1.Image, refs []string) ([]string, error)
+}
+
+// WithSource reads references of the form <scheme>:<ref> with src. It takes
+// precedence over the built-in tarball, oci and docker-daemon schemes. The
+// empty scheme replaces the registry, which otherwise reads every reference
+// without a known scheme. src may wrap the built-in source for the scheme,
+// from DefaultSource.
+func WithSource(scheme string, src ImageSource) Option {
+	return func(r *Rebaser) {
+		sources := map[string]ImageSource{scheme: src}
+		for k, v := range r.sources {
+			if k != scheme {
+				sources[k] = v
+			}
+		}
+		r.sources = sources
+	}
+}
+
+// WithSink writes rebased images to references of the form <scheme>:<ref>
+// with sink. It takes precedence over the built-in tarball, oci and
+// docker-daemon schemes. The empty scheme replaces the registry, which
+// otherwise receives every reference without a known scheme. sink may wrap
+// the built-in sink for the scheme, from DefaultSink.
+func WithSink(scheme string, sink ImageSink) Option {
+	return func(r *Rebaser) {
+		sinks := map[string]ImageSink{scheme: sink}
+		for k, v := range r.sinks {
+			if k != scheme {
+				sinks[k] = v
+			}
+		}
+		r.sinks = sinks
+	}
+}
+
+// builtinSchemes are the schemes of the references that are not read from
+// or written to a registry by default.
+var builtinSchemes = []string{tarballScheme, layoutScheme, daemonScheme}
+
+// DefaultSource returns the built-in source for scheme, which a Rebaser uses
+// when no source is registered for it: the registry for the empty scheme,
+// and "docker save" archives, image layouts and the Docker Engine for
+// "tarball", "oci" and "docker-daemon". It returns nil for any other scheme.
+//
+// The source reads with the options of the Rebaser that calls it, and can
+// only be called by one, typically from a source registered with WithSource
+// that wraps it.
+func DefaultSource(scheme string) ImageSource {
+	if !isBuiltinScheme(scheme) {
+		return nil
+	}
+	return builtinSource{scheme: scheme}
+}
+
+// DefaultSink returns the built-in sink for scheme, which a Rebaser uses when
+// no sink is registered for it, as DefaultSource does for sources. The sink
+// returns the references it wrote to as Rebase reports them, with their
+// scheme.
+func DefaultSink(scheme string) ImageSink {
+	if !isBuiltinScheme(scheme) {
+		return nil
+	}
+	return builtinSink{scheme: scheme}
+}
+
+func isBuiltinScheme(scheme string) bool {
+	if scheme == "" {
+		return true
+	}
+	for _, s := range builtinSchemes {
+		if scheme+":" == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rebaseKey is the context key under which the built-in sources and sinks
+// find the rebase that calls them.
+type rebaseKey struct{}
+
+// rebaseState is the Rebaser and transport of a rebase.
+type rebaseState struct {
+	r Rebaser
+	t *contextTransport
+}
+
+// sourceContext returns the context for calls to sources and sinks, which is
+// that of the current phase of t.
+func (r Rebaser) sourceContext(t *contextTransport) context.Context {
+	return context.WithValue(t.context(), rebaseKey{}, rebaseState{r: r, t: t})
+}
+
+// calledBy returns the rebase that a built-in source or sink is called by.
+func calledBy(ctx context.Context) (rebaseState, error) {
+	st, ok := ctx.Value(rebaseKey{}).(rebaseState)
+	if !ok {
+		return rebaseState{}, errors.New("built-in source or sink called outside a rebase")
+	}
+	return st, nil
+}
+
+// builtinSource implements ImageSource for a built-in scheme.
+type builtinSource struct {
+	scheme string
+}
+
+// Image implements ImageSource
+func (s builtinSource) Image(ctx context.Context, ref string) (v1.Image, error) {
+	st, err := calledBy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch s.scheme + ":" {
+	case tarballScheme:
+		return st.r.tarballImage(ref)
+	case layoutScheme:
+		return st.r.layoutImage(ref)
+	case daemonScheme:
+		return st.r.daemonImage(st.t, ref)
+	}
+	return st.r.remoteImage(st.t, ref)
+}
+
+// builtinSink implements ImageSink for a built-in scheme.
+type builtinSink struct {
+	scheme string
+}
+
+// Write implements ImageSink
+func (s builtinSink) Write(ctx context.Context, img v1.Image, refs []string) ([]string, error) {
+	st, err := calledBy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if s.scheme != "" {
+		prefix = s.scheme + ":"
+	}
+	strs := make([]string, len(refs))
+	for i, ref := range refs {
+		if prefix == "" && hasBuiltinScheme(ref) {
+			return nil, fmt.Errorf("%q is not a registry reference", ref)
+		}
+		strs[i] = prefix + ref
+	}
+	// Without the registered sinks, every destination is a built-in one.
+	r := st.r
+	r.sinks = nil
+	dsts, err := r.parseDestinations(strs)
+	if err != nil {
+		return nil, err
+	}
+	return r.push(st.t, img, dsts)
+}
+
+// hasBuiltinScheme reports whether s starts with a built-in scheme.
+func hasBuiltinScheme(s string) bool {
+	for _, scheme := range builtinSchemes {
+		if strings.HasPrefix(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitScheme returns the scheme of s, as registered with WithSource or
+// WithSink in schemes, and s without it. It returns false if no scheme in
+// schemes applies to s.
+func splitScheme(s string, schemes map[string]bool) (string, string, bool) {
+	for scheme := range schemes {
+		if scheme != "" && strings.HasPrefix(s, scheme+":") {
+			return scheme, strings.TrimPrefix(s, scheme+":"), true
+		}
+	}
+	if !schemes[""] || hasBuiltinScheme(s) {
+		return "", "", false
+	}
+	return "", s, true
+}
+
+// source returns the registered source for s and s without its scheme, or
+// nil if s is read by a built-in source.
+func (r Rebaser) source(s string) (ImageSource, string) {
+	schemes := map[string]bool{}
+	for scheme := range r.sources {
+		schemes[scheme] = true
+	}
+	scheme, ref, ok := splitScheme(s, schemes)
+	if !ok {
+		return nil, ""
+	}
+	return r.sources[scheme], ref
+}
+
+// sink returns the scheme under which a sink is registered for s, and s
+// without it. It returns false if s is written by a built-in sink.
+func (r Rebaser) sink(s string) (string, string, bool) {
+	schemes := map[string]bool{}
+	for scheme := range r.sinks {
+		schemes[scheme] = true
+	}
+	return splitScheme(s, schemes)
+}
+
+// writeSinks writes img to the destinations in dsts that have a registered
+// sink, calling each sink once with all of its references, and records the
+// references reported by the sinks in refs.
+func (r Rebaser) writeSinks(t *contextTransport, img v1.Image, dsts []destination, refs []string) error {
+	var schemes []string
+	indexes := map[string][]int{}
+	for i, d := range dsts {
+		if d.sink == nil {
+			continue
+		}
+		if _, ok := indexes[d.scheme]; !ok {
+			schemes = append(schemes, d.scheme)
+		}
+		indexes[d.scheme] = append(indexes[d.scheme], i)
+	}
+
+	for _, scheme := range schemes {
+		var strs []string
+		for _, i := range indexes[scheme] {
+			strs = append(strs, dsts[i].rest)
+		}
+		first := dsts[indexes[scheme][0]]
+		written, err := first.sink.Write(r.sourceContext(t), img, strs)
+		if err == nil && len(written) != len(strs) {
+			err = fmt.Errorf("sink returned %d references for %d destinations", len(written), len(strs))
+		}
+		if err != nil {
+			r.logger.Warn("write failed", "ref", first.str, "error", err)
+			return fmt.Errorf("could not write new image to %q: %w", first.str, err)
+		}
+		for n, i := range indexes[scheme] {
+			refs[i] = written[n]
+			r.logger.Info("wrote image", "ref", written[n])
+		}
+	}
+	return nil
+}
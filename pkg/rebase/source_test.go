@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// countingSource counts the images read through a source.
+type countingSource struct {
+	ImageSource
+	refs []string
+}
+
+func (s *countingSource) Image(ctx context.Context, ref string) (v1.Image, error) {
+	s.refs = append(s.refs, ref)
+	return s.ImageSource.Image(ctx, ref)
+}
+
+// countingSink records the references written through a sink.
+type countingSink struct {
+	ImageSink
+	refs []string
+}
+
+func (s *countingSink) Write(ctx context.Context, img v1.Image, refs []string) ([]string, error) {
+	s.refs = append(s.refs, refs...)
+	return s.ImageSink.Write(ctx, img, refs)
+}
+
+func TestWrapDefaultRegistry(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	src := &countingSource{ImageSource: DefaultSource("")}
+	sink := &countingSink{ImageSink: DefaultSink("")}
+	r := New(nil, nil, WithSource("", src), WithSink("", sink))
+
+	res, err := r.Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1", reg.host+"/out:2")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	if len(src.refs) != 3 || src.refs[0] != reg.host+"/app:1" {
+		t.Errorf("source read %v, want the original and both bases", src.refs)
+	}
+	if len(sink.refs) != 2 || sink.refs[1] != reg.host+"/out:2" {
+		t.Errorf("sink wrote %v, want out:1 and out:2", sink.refs)
+	}
+	if len(res.References) != 2 || res.References[0] != reg.host+"/out:1" {
+		t.Errorf("References = %v", res.References)
+	}
+	for _, tag := range []string{"1", "2"} {
+		if !reg.has("out", tag) {
+			t.Errorf("out:%s was not pushed", tag)
+		}
+	}
+}
+
+func TestWrapDefaultTarball(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	sink := &countingSink{ImageSink: DefaultSink("tarball")}
+	r := New(nil, nil, WithSink("tarball", sink))
+
+	path := filepath.Join(t.TempDir(), "out.tar")
+	res, err := r.Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", tarballScheme+path+":out:1")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	if len(sink.refs) != 1 || sink.refs[0] != path+":out:1" {
+		t.Errorf("sink wrote %v, want %s", sink.refs, path+":out:1")
+	}
+	if want := tarballScheme + path + ":"; !strings.HasPrefix(res.Reference, want) {
+		t.Errorf("Reference = %q, want it in %s", res.Reference, path)
+	}
+	img, err := tarball.ImageFromPath(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mustDigest(t, img); got != res.Digest {
+		t.Errorf("archive holds %s, want %s", got, res.Digest)
+	}
+}
+
+func TestDefaultSourceOutsideRebase(t *testing.T) {
+	if DefaultSource("nope") != nil || DefaultSink("nope") != nil {
+		t.Error("DefaultSource and DefaultSink returned a value for an unknown scheme")
+	}
+	if _, err := DefaultSource("").Image(context.Background(), "example.com/app:1"); err == nil {
+		t.Error("DefaultSource(\"\").Image() succeeded outside a rebase")
+	}
+}
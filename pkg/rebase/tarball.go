@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// tarballScheme prefixes references to "docker save" archives, in the form
+// tarball:<path>[:<tag>].
+const tarballScheme = "tarball:"
+
+// splitTarballRef splits a tarball reference, without its scheme, into the
+// archive's path and the tag that selects an image within it, if any. The
+// path may contain colons: a reference that names an existing file has no
+// tag, and otherwise the tag follows the second to last colon, since a tag
+// of the form <repository>:<tag> has one of its own. A tag that follows a
+// path with a colon must be of that form.
+func (r Rebaser) splitTarballRef(s string) (string, *name.Tag, error) {
+	if _, err := os.Stat(s); err == nil {
+		return s, nil, nil
+	}
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return s, nil, nil
+	}
+	if j := strings.LastIndex(s[:i], ":"); j >= 0 {
+		i = j
+	}
+	tag, err := name.NewTag(s[i+1:], r.strictness)
+	if err != nil {
+		return "", nil, err
+	}
+	return s[:i], &tag, nil
+}
+
+// tarballImage reads an image from a "docker save" archive. The tag may be
+// omitted if the archive holds a single image.
+func (r Rebaser) tarballImage(s string) (v1.Image, error) {
+	path, tag, err := r.splitTarballRef(s)
+	if err != nil {
+		return nil, err
+	}
+	return tarball.ImageFromPath(path, tag)
+}
+
+// writeTarball writes a "docker save" archive holding each image under its
+// tags to path, or to stdout if path is "-".
+func writeTarball(path string, tagToImage map[name.Tag]v1.Image) error {
+	if path == "-" {
+		return tarball.MultiWrite(tagToImage, os.Stdout)
+	}
+	return tarball.MultiWriteToFile(path, tagToImage)
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitTarballRef(t *testing.T) {
+	existing := filepath.Join(t.TempDir(), "a:b.tar")
+	if err := ioutil.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := New(nil, nil)
+	for _, tc := range []struct {
+		in, path, tag string
+	}{
+		{in: "out.tar", path: "out.tar"},
+		{in: "out.tar:app", path: "out.tar", tag: "index.docker.io/library/app:latest"},
+		{in: "out.tar:app:1", path: "out.tar", tag: "index.docker.io/library/app:1"},
+		{in: "out.tar:gcr.io/foo/app:1", path: "out.tar", tag: "gcr.io/foo/app:1"},
+		{in: "a:b/out.tar:app:1", path: "a:b/out.tar", tag: "index.docker.io/library/app:1"},
+		{in: existing, path: existing},
+		{in: existing + ":app:1", path: existing, tag: "index.docker.io/library/app:1"},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			path, tag, err := r.splitTarballRef(tc.in)
+			if err != nil {
+				t.Fatalf("splitTarballRef() = %v", err)
+			}
+			got := ""
+			if tag != nil {
+				got = tag.String()
+			}
+			if path != tc.path || got != tc.tag {
+				t.Errorf("splitTarballRef() = %q, %q, want %q, %q", path, got, tc.path, tc.tag)
+			}
+		})
+	}
+}
+
+func TestTarballRoundTrip(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+	path := filepath.Join(t.TempDir(), "a:b", "rebased.tar")
+	if err := os.Mkdir(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(nil, nil)
+	res, err := r.Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", "tarball:"+path+":app:2", "tarball:"+path+":gcr.io/foo/app:latest")
+	if err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	want := []string{"tarball:" + path + ":index.docker.io/library/app:2", "tarball:" + path + ":gcr.io/foo/app:latest"}
+	if len(res.References) != len(want) {
+		t.Fatalf("References = %v, want %v", res.References, want)
+	}
+	// Each tag reads back the rebased image, by the reference reported for it.
+	rt := r.roundTripper(context.Background())
+	defer rt.close()
+	for i, ref := range res.References {
+		if ref != want[i] {
+			t.Errorf("References[%d] = %q, want %q", i, ref, want[i])
+		}
+		img, err := r.get(rt, ref)
+		if err != nil {
+			t.Fatalf("get(%q) = %v", ref, err)
+		}
+		if got := mustDigest(t, img); got != res.Digest {
+			t.Errorf("%s has digest %s, want %s", ref, got, res.Digest)
+		}
+	}
+	if _, err := r.tarballImage(path + ":app:3"); err == nil {
+		t.Error("tarballImage() of a tag not in the archive succeeded")
+	}
+}
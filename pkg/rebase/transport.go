@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how registry requests that fail transiently are
+// retried. Requests whose body cannot be replayed, such as blob uploads, are
+// never retried.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts per request, including the
+	// first. Values below 2 disable retries.
+	Attempts int
+	// Backoff is the delay before the first retry. It doubles after every
+	// subsequent attempt.
+	Backoff time.Duration
+}
+
+// roundTripper returns the transport for a single rebase, bound to ctx. The
+// standard logger is taken over until the transport is closed.
+func (r Rebaser) roundTripper(ctx context.Context) *contextTransport {
+	t := r.transport
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	if r.userAgent != "" {
+		t = &userAgentTransport{inner: t, ua: r.userAgent}
+	}
+	if r.retry.Attempts > 1 {
+		t = &retryTransport{inner: t, policy: r.retry}
+	}
+	ct := newContextTransport(ctx, t)
+	ct.onClose(stdLog.capture(r.logger))
+	return ct
+}
+
+type userAgentTransport struct {
+	inner http.RoundTripper
+	ua    string
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.ua)
+	return t.inner.RoundTrip(req)
+}
+
+type retryTransport struct {
+	inner  http.RoundTripper
+	policy RetryPolicy
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := t.inner.RoundTrip(req)
+		if attempt >= t.policy.Attempts || !retryable(req, resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+
+		if req.Body != nil && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryable reports whether the outcome of req is transient and req can
+// safely be sent again.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
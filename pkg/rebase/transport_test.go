@@ -0,0 +1,164 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rebase
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRetry(t *testing.T) {
+	for _, tc := range []struct {
+		attempts, failures int
+		ok                 bool
+	}{
+		{attempts: 0, failures: 1, ok: false},
+		{attempts: 3, failures: 2, ok: true},
+		{attempts: 3, failures: 3, ok: false},
+	} {
+		t.Run(fmt.Sprintf("%d attempts, %d failures", tc.attempts, tc.failures), func(t *testing.T) {
+			reg := newTestRegistry(t)
+			reg.pushTestImages(t)
+			failures := tc.failures
+			reg.fail = func(r *http.Request) (int, string) {
+				if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v2/app/manifests/") && failures > 0 {
+					failures--
+					return http.StatusServiceUnavailable, ""
+				}
+				return 0, ""
+			}
+
+			r := New(nil, nil, WithRetry(RetryPolicy{Attempts: tc.attempts}))
+			_, err := r.Rebase(reg.host+"/app:1", reg.host+"/old:1", reg.host+"/new:1", reg.host+"/out:1")
+			if ok := err == nil; ok != tc.ok {
+				t.Errorf("Rebase() = %v, want success %t", err, tc.ok)
+			}
+			want := tc.attempts
+			if want < 1 {
+				want = 1
+			}
+			if tc.ok {
+				want = tc.failures + 1
+			}
+			if n := reg.count("GET", "/v2/app/manifests/"); n != want {
+				t.Errorf("original manifest fetched %d times, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestRetryBody(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+	rt := &retryTransport{inner: http.DefaultTransport, policy: RetryPolicy{Attempts: 3}}
+
+	for _, tc := range []struct {
+		desc string
+		body io.Reader
+		want []string
+	}{
+		// http.NewRequest can replay the body of a bytes.Reader.
+		{desc: "rewindable", body: bytes.NewReader([]byte("blob")), want: []string{"blob", "blob", "blob"}},
+		{desc: "not rewindable", body: ioutil.NopCloser(strings.NewReader("blob")), want: []string{"blob"}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			bodies = nil
+			req, err := http.NewRequest(http.MethodPatch, s.URL+"/v2/app/blobs/uploads/1", tc.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("RoundTrip() status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if fmt.Sprint(bodies) != fmt.Sprint(tc.want) {
+				t.Errorf("server received %q, want %q", bodies, tc.want)
+			}
+		})
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.pushTestImages(t)
+
+	// Serve reg behind token authentication, recording the User-Agent of
+	// every request.
+	var mu sync.Mutex
+	agents := map[string][]string{}
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents[r.URL.Path] = append(agents[r.URL.Path], r.Header.Get("User-Agent"))
+		mu.Unlock()
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"token": "secret"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q,service="test"`, s.URL+"/token"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := u.Host
+
+	r := New(nil, nil, WithUserAgent("rebase-test/1.0"))
+	if _, err := r.Rebase(host+"/app:1", host+"/old:1", host+"/new:1", host+"/out:1"); err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(agents["/token"]) == 0 {
+		t.Fatal("no token was fetched")
+	}
+	for path, uas := range agents {
+		for _, ua := range uas {
+			if ua != "rebase-test/1.0" {
+				t.Errorf("request to %s had User-Agent %q, want %q", path, ua, "rebase-test/1.0")
+			}
+		}
+	}
+}